@@ -9,3 +9,9 @@ type Interface interface {
 	Set(path string, file *virt.File) error
 	Link(from string, to ...string) error
 }
+
+// Deleter is implemented by caches that can evict paths along with every file
+// linked to them
+type Deleter interface {
+	Delete(paths ...string) error
+}
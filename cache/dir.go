@@ -0,0 +1,307 @@
+package cache
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/matthewmueller/virt"
+)
+
+// version is stamped into the cache directory. Bump it whenever the on-disk
+// format changes so older caches are discarded rather than misread.
+const version = "genfs-cache-v1"
+
+// Dir returns a cache that persists files and their links in dir, so they
+// survive restarts. Writes are atomic, so a crash mid-write leaves the
+// previous entry intact.
+func Dir(dir string) (*Disk, error) {
+	d := &Disk{dir: dir, links: newLinks()}
+	if err := d.load(); err != nil {
+		return nil, fmt.Errorf("cache: unable to load %q: %w", dir, err)
+	}
+	return d, nil
+}
+
+// Disk is an on-disk cache. Links are kept in memory and appended to a log
+// along with the next file, so call Close to persist links made since then.
+// The log is compacted into a snapshot when the cache is opened or closed.
+type Disk struct {
+	mu      sync.Mutex
+	dir     string
+	links   *links
+	pending []linkRecord // changes to the links that haven't been logged yet
+	log     *os.File     // opened on the first write
+}
+
+var _ Interface = (*Disk)(nil)
+var _ Deleter = (*Disk)(nil)
+
+// linkRecord is a line in the links log. It either adds links or removes
+// every link from a path.
+type linkRecord struct {
+	From   string   `json:"from,omitempty"`
+	To     []string `json:"to,omitempty"`
+	Remove string   `json:"remove,omitempty"`
+}
+
+// diskEntry is the on-disk representation of a cached file
+type diskEntry struct {
+	Path string
+	File *virt.File
+}
+
+func (d *Disk) Get(path string) (*virt.File, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	data, err := os.ReadFile(d.filePath(path))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, fs.ErrNotExist
+		}
+		return nil, err
+	}
+	var entry diskEntry
+	if err := json.Unmarshal(data, &entry); err != nil || entry.Path != path || entry.File == nil {
+		// Treat unreadable entries as a miss so they get regenerated
+		os.Remove(d.filePath(path))
+		return nil, fs.ErrNotExist
+	}
+	return entry.File, nil
+}
+
+func (d *Disk) Set(path string, file *virt.File) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	data, err := json.Marshal(diskEntry{path, file})
+	if err != nil {
+		return err
+	}
+	// Log the links first, so cached files always have their links on disk
+	if err := d.flush(); err != nil {
+		return err
+	}
+	return writeFile(d.filePath(path), data)
+}
+
+// Link records that the file at from depends on each of the toPatterns paths.
+// Links accumulate across calls and are persisted by the next Set, Delete or
+// Close.
+func (d *Disk) Link(from string, toPatterns ...string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.links.link(from, toPatterns...)
+	d.pending = append(d.pending, linkRecord{From: from, To: toPatterns})
+	return nil
+}
+
+// Delete evicts the paths along with every file that transitively depends on
+// them.
+func (d *Disk) Delete(paths ...string) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, path := range d.links.dependents(paths...) {
+		if err := os.Remove(d.filePath(path)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		d.links.remove(path)
+		d.pending = append(d.pending, linkRecord{Remove: path})
+	}
+	return d.flush()
+}
+
+// Close persists any links that haven't been written yet and compacts the
+// links log.
+func (d *Disk) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if err := d.flush(); err != nil {
+		return err
+	}
+	return d.compact()
+}
+
+// Clear removes every entry from the cache.
+func (d *Disk) Clear() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.links = newLinks()
+	d.pending = nil
+	return d.reset()
+}
+
+func (d *Disk) filePath(path string) string {
+	hash := sha256.Sum256([]byte(path))
+	return filepath.Join(d.dir, "files", hex.EncodeToString(hash[:]))
+}
+
+func (d *Disk) load() error {
+	if err := os.MkdirAll(filepath.Join(d.dir, "files"), 0755); err != nil {
+		return err
+	}
+	// Remove any temporary files left behind by a crash
+	for _, pattern := range []string{filepath.Join(d.dir, ".tmp-*"), filepath.Join(d.dir, "files", ".tmp-*")} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return err
+		}
+		for _, match := range matches {
+			if err := os.Remove(match); err != nil {
+				return err
+			}
+		}
+	}
+	// Discard caches written in a different format
+	stamp, err := os.ReadFile(filepath.Join(d.dir, "version"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	if string(stamp) != version {
+		return d.reset()
+	}
+	data, err := os.ReadFile(filepath.Join(d.dir, "links.json"))
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	} else if err == nil {
+		if err := json.Unmarshal(data, d.links); err != nil {
+			// Without links we can't invalidate correctly, so start over
+			d.links = newLinks()
+			return d.reset()
+		}
+	}
+	if err := d.replay(); err != nil {
+		return err
+	}
+	return d.compact()
+}
+
+// replay the links log on top of the snapshot
+func (d *Disk) replay() error {
+	data, err := os.ReadFile(filepath.Join(d.dir, "links.log"))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+	for _, line := range bytes.Split(data, []byte("\n")) {
+		var record linkRecord
+		if err := json.Unmarshal(line, &record); err != nil {
+			// The last line is torn when a crash interrupts a write. The file it
+			// belongs to wasn't written yet, so the rest of the log is safe to
+			// ignore.
+			break
+		}
+		if record.Remove != "" {
+			d.links.remove(record.Remove)
+			continue
+		}
+		d.links.link(record.From, record.To...)
+	}
+	return nil
+}
+
+// reset removes the cached files and links and stamps the current version
+func (d *Disk) reset() error {
+	if err := d.closeLog(); err != nil {
+		return err
+	}
+	if err := os.RemoveAll(filepath.Join(d.dir, "files")); err != nil {
+		return err
+	}
+	for _, name := range []string{"links.json", "links.log"} {
+		if err := os.Remove(filepath.Join(d.dir, name)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(d.dir, "files"), 0755); err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(d.dir, "version"), []byte(version))
+}
+
+// flush appends the pending links to the log. Only the changes are written,
+// so the cost doesn't grow with the number of links.
+func (d *Disk) flush() error {
+	if len(d.pending) == 0 {
+		return nil
+	}
+	buf := new(bytes.Buffer)
+	enc := json.NewEncoder(buf)
+	for _, record := range d.pending {
+		if err := enc.Encode(record); err != nil {
+			return err
+		}
+	}
+	if d.log == nil {
+		log, err := os.OpenFile(filepath.Join(d.dir, "links.log"), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err != nil {
+			return err
+		}
+		d.log = log
+	}
+	if _, err := d.log.Write(buf.Bytes()); err != nil {
+		return err
+	}
+	if err := d.log.Sync(); err != nil {
+		return err
+	}
+	d.pending = nil
+	return nil
+}
+
+// compact writes the links to a snapshot and removes the log
+func (d *Disk) compact() error {
+	data, err := json.Marshal(d.links)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(filepath.Join(d.dir, "links.json"), data); err != nil {
+		return err
+	}
+	if err := d.closeLog(); err != nil {
+		return err
+	}
+	if err := os.Remove(filepath.Join(d.dir, "links.log")); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+func (d *Disk) closeLog() error {
+	if d.log == nil {
+		return nil
+	}
+	err := d.log.Close()
+	d.log = nil
+	return err
+}
+
+// writeFile atomically writes data to fpath by writing to a temporary file
+// and renaming it into place.
+func writeFile(fpath string, data []byte) error {
+	tmp, err := os.CreateTemp(filepath.Dir(fpath), ".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), fpath)
+}
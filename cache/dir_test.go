@@ -0,0 +1,137 @@
+package cache_test
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/genfs/cache"
+	"github.com/matthewmueller/virt"
+)
+
+func TestDirPersist(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+	c, err := cache.Dir(dir)
+	is.NoErr(err)
+	_, err = c.Get("a.txt")
+	is.True(errors.Is(err, fs.ErrNotExist))
+	is.NoErr(c.Set("a.txt", &virt.File{Path: "a.txt", Data: []byte("a"), Mode: 0644}))
+	is.NoErr(c.Set("dist", &virt.File{
+		Path: "dist",
+		Mode: fs.ModeDir,
+		Entries: []*virt.DirEntry{
+			{Path: "dist/index.html", Size: 3},
+		},
+	}))
+	is.NoErr(c.Link("a.txt", "b.txt"))
+	is.NoErr(c.Close())
+
+	// Reopen the cache
+	c, err = cache.Dir(dir)
+	is.NoErr(err)
+	file, err := c.Get("a.txt")
+	is.NoErr(err)
+	is.Equal(file.Path, "a.txt")
+	is.Equal(string(file.Data), "a")
+	is.Equal(file.Mode, fs.FileMode(0644))
+	file, err = c.Get("dist")
+	is.NoErr(err)
+	is.Equal(file.Mode, fs.ModeDir)
+	is.Equal(len(file.Entries), 1)
+	is.Equal(file.Entries[0].Path, "dist/index.html")
+	is.Equal(file.Entries[0].Size, int64(3))
+
+	// Links survive restarts
+	is.NoErr(c.Delete("b.txt"))
+	_, err = c.Get("a.txt")
+	is.True(errors.Is(err, fs.ErrNotExist))
+	_, err = c.Get("dist")
+	is.NoErr(err)
+}
+
+func TestDirVersion(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+	c, err := cache.Dir(dir)
+	is.NoErr(err)
+	is.NoErr(c.Set("a.txt", &virt.File{Path: "a.txt", Data: []byte("a")}))
+	is.NoErr(os.WriteFile(filepath.Join(dir, "version"), []byte("genfs-cache-v0"), 0644))
+	c, err = cache.Dir(dir)
+	is.NoErr(err)
+	_, err = c.Get("a.txt")
+	is.True(errors.Is(err, fs.ErrNotExist))
+}
+
+func TestDirCorrupt(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+	c, err := cache.Dir(dir)
+	is.NoErr(err)
+	is.NoErr(c.Set("a.txt", &virt.File{Path: "a.txt", Data: []byte("a")}))
+	// Simulate a crash that left a temporary file and a torn entry
+	is.NoErr(os.WriteFile(filepath.Join(dir, "files", ".tmp-123"), []byte("{"), 0644))
+	entries, err := filepath.Glob(filepath.Join(dir, "files", "*"))
+	is.NoErr(err)
+	for _, entry := range entries {
+		if filepath.Base(entry)[0] != '.' {
+			is.NoErr(os.WriteFile(entry, []byte(`{"Path":"a.t`), 0644))
+		}
+	}
+	c, err = cache.Dir(dir)
+	is.NoErr(err)
+	_, err = os.Stat(filepath.Join(dir, "files", ".tmp-123"))
+	is.True(errors.Is(err, fs.ErrNotExist))
+	_, err = c.Get("a.txt")
+	is.True(errors.Is(err, fs.ErrNotExist))
+	is.NoErr(c.Set("a.txt", &virt.File{Path: "a.txt", Data: []byte("a")}))
+	file, err := c.Get("a.txt")
+	is.NoErr(err)
+	is.Equal(string(file.Data), "a")
+}
+
+func TestDirLinkDeferred(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+	c, err := cache.Dir(dir)
+	is.NoErr(err)
+	// Links aren't written on every call
+	is.NoErr(c.Link("a.txt", "b.txt", "c.txt"))
+	_, err = os.Stat(filepath.Join(dir, "links.log"))
+	is.True(errors.Is(err, fs.ErrNotExist))
+
+	// Setting a file appends its links to the log first
+	is.NoErr(c.Set("a.txt", &virt.File{Path: "a.txt", Data: []byte("a")}))
+	data, err := os.ReadFile(filepath.Join(dir, "links.log"))
+	is.NoErr(err)
+	is.Equal(string(data), `{"from":"a.txt","to":["b.txt","c.txt"]}`+"\n")
+	is.NoErr(c.Link("d.txt", "a.txt"))
+	is.NoErr(c.Set("d.txt", &virt.File{Path: "d.txt", Data: []byte("d")}))
+	data, err = os.ReadFile(filepath.Join(dir, "links.log"))
+	is.NoErr(err)
+	is.Equal(string(data), `{"from":"a.txt","to":["b.txt","c.txt"]}`+"\n"+`{"from":"d.txt","to":["a.txt"]}`+"\n")
+
+	// Reopening without closing replays the log, ignoring a torn last line
+	log, err := os.OpenFile(filepath.Join(dir, "links.log"), os.O_APPEND|os.O_WRONLY, 0644)
+	is.NoErr(err)
+	_, err = log.WriteString(`{"from":"e.t`)
+	is.NoErr(err)
+	is.NoErr(log.Close())
+	c, err = cache.Dir(dir)
+	is.NoErr(err)
+	// Opening compacts the log into a snapshot
+	_, err = os.Stat(filepath.Join(dir, "links.log"))
+	is.True(errors.Is(err, fs.ErrNotExist))
+	is.NoErr(c.Delete("c.txt"))
+	_, err = c.Get("a.txt")
+	is.True(errors.Is(err, fs.ErrNotExist))
+	_, err = c.Get("d.txt")
+	is.True(errors.Is(err, fs.ErrNotExist))
+	is.NoErr(c.Close())
+	data, err = os.ReadFile(filepath.Join(dir, "links.json"))
+	is.NoErr(err)
+	is.Equal(string(data), `{}`)
+}
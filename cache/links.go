@@ -0,0 +1,119 @@
+package cache
+
+import (
+	"encoding/json"
+	"path"
+	"slices"
+	"strings"
+)
+
+// links is a dependency graph from cached paths to the path patterns they were
+// generated from. Literal paths are indexed in reverse so finding the
+// dependents of a path doesn't need to scan every link. Only glob patterns are
+// matched one by one.
+type links struct {
+	to       map[string][]string        // from -> to patterns
+	literals map[string]map[string]bool // literal to -> from
+	globs    map[string]map[string]bool // glob to -> from
+}
+
+func newLinks() *links {
+	return &links{
+		to:       map[string][]string{},
+		literals: map[string]map[string]bool{},
+		globs:    map[string]map[string]bool{},
+	}
+}
+
+func (l *links) link(from string, toPatterns ...string) {
+	for _, to := range toPatterns {
+		if slices.Contains(l.to[from], to) {
+			continue
+		}
+		l.to[from] = append(l.to[from], to)
+		index := l.literals
+		if isGlob(to) {
+			index = l.globs
+		}
+		if index[to] == nil {
+			index[to] = map[string]bool{}
+		}
+		index[to][from] = true
+	}
+}
+
+// remove the links from the path
+func (l *links) remove(from string) {
+	for _, to := range l.to[from] {
+		index := l.literals
+		if isGlob(to) {
+			index = l.globs
+		}
+		delete(index[to], from)
+		if len(index[to]) == 0 {
+			delete(index, to)
+		}
+	}
+	delete(l.to, from)
+}
+
+// dependents returns the paths along with every path that transitively
+// depends on them.
+func (l *links) dependents(paths ...string) (dependents []string) {
+	seen := map[string]bool{}
+	queue := append([]string{}, paths...)
+	for len(queue) > 0 {
+		p := queue[0]
+		queue = queue[1:]
+		if seen[p] {
+			continue
+		}
+		seen[p] = true
+		dependents = append(dependents, p)
+		for from := range l.literals[p] {
+			if !seen[from] {
+				queue = append(queue, from)
+			}
+		}
+		for pattern, froms := range l.globs {
+			if !matchGlob(pattern, p) {
+				continue
+			}
+			for from := range froms {
+				if !seen[from] {
+					queue = append(queue, from)
+				}
+			}
+		}
+	}
+	return dependents
+}
+
+// MarshalJSON encodes the links as a map from each path to its patterns
+func (l *links) MarshalJSON() ([]byte, error) {
+	return json.Marshal(l.to)
+}
+
+func (l *links) UnmarshalJSON(data []byte) error {
+	var to map[string][]string
+	if err := json.Unmarshal(data, &to); err != nil {
+		return err
+	}
+	*l = *newLinks()
+	for from, toPatterns := range to {
+		l.link(from, toPatterns...)
+	}
+	return nil
+}
+
+func isGlob(pattern string) bool {
+	return strings.ContainsAny(pattern, `*?[\`)
+}
+
+func matchGlob(pattern, fpath string) bool {
+	if pattern == fpath {
+		return true
+	}
+	ok, err := path.Match(pattern, fpath)
+	return err == nil && ok
+}
@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"container/list"
+	"io/fs"
+	"sync"
+
+	"github.com/matthewmueller/virt"
+)
+
+// LRU returns a new in-memory cache that holds at most maxBytes of files,
+// evicting the least recently used files first.
+func LRU(maxBytes int64) *Bounded {
+	return &Bounded{
+		maxBytes: maxBytes,
+		order:    list.New(),
+		files:    map[string]*list.Element{},
+		links:    newLinks(),
+	}
+}
+
+// Bounded is a size-bounded in-memory cache. It's safe for concurrent use.
+type Bounded struct {
+	mu       sync.Mutex
+	maxBytes int64
+	size     int64
+	order    *list.List // front is most recently used
+	files    map[string]*list.Element
+	links    *links
+}
+
+var _ Interface = (*Bounded)(nil)
+var _ Deleter = (*Bounded)(nil)
+
+type lruEntry struct {
+	path string
+	file *virt.File
+	size int64
+}
+
+func (b *Bounded) Get(path string) (*virt.File, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	elem, ok := b.files[path]
+	if !ok {
+		return nil, fs.ErrNotExist
+	}
+	b.order.MoveToFront(elem)
+	return elem.Value.(*lruEntry).file, nil
+}
+
+func (b *Bounded) Set(path string, file *virt.File) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.remove(path)
+	size := sizeOf(path, file)
+	// Files larger than the budget are never cached
+	if size > b.maxBytes {
+		return nil
+	}
+	b.files[path] = b.order.PushFront(&lruEntry{path, file, size})
+	b.size += size
+	// Evicted files keep their links, so files generated from them are still
+	// invalidated when their inputs change
+	for b.size > b.maxBytes {
+		b.remove(b.order.Back().Value.(*lruEntry).path)
+	}
+	return nil
+}
+
+// Link records that the file at from depends on each of the toPatterns paths.
+// Links accumulate across calls.
+func (b *Bounded) Link(from string, toPatterns ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.links.link(from, toPatterns...)
+	return nil
+}
+
+// Delete evicts the paths along with every file that transitively depends on
+// them.
+func (b *Bounded) Delete(paths ...string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, path := range b.links.dependents(paths...) {
+		b.remove(path)
+		b.links.remove(path)
+	}
+	return nil
+}
+
+// Size returns the number of bytes currently cached.
+func (b *Bounded) Size() int64 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.size
+}
+
+func (b *Bounded) Clear() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.size = 0
+	b.order.Init()
+	b.files = map[string]*list.Element{}
+	b.links = newLinks()
+}
+
+func (b *Bounded) remove(path string) {
+	elem, ok := b.files[path]
+	if !ok {
+		return
+	}
+	b.size -= elem.Value.(*lruEntry).size
+	b.order.Remove(elem)
+	delete(b.files, path)
+}
+
+// sizeOf approximates the memory used by a cached file
+func sizeOf(path string, file *virt.File) int64 {
+	size := int64(len(path) + len(file.Path) + len(file.Data))
+	for _, entry := range file.Entries {
+		size += int64(len(entry.Path))
+	}
+	return size
+}
@@ -0,0 +1,141 @@
+package cache_test
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sync"
+	"testing"
+
+	"github.com/matryer/is"
+	"github.com/matthewmueller/genfs/cache"
+	"github.com/matthewmueller/virt"
+)
+
+func TestLRUEvict(t *testing.T) {
+	is := is.New(t)
+	c := cache.LRU(30)
+	// Each entry is 5+5+5 = 15 bytes
+	is.NoErr(c.Set("a.txt", &virt.File{Path: "a.txt", Data: []byte("aaaaa")}))
+	is.NoErr(c.Set("b.txt", &virt.File{Path: "b.txt", Data: []byte("bbbbb")}))
+	is.Equal(c.Size(), int64(30))
+	// Touch a.txt so b.txt is the least recently used
+	_, err := c.Get("a.txt")
+	is.NoErr(err)
+	is.NoErr(c.Set("c.txt", &virt.File{Path: "c.txt", Data: []byte("ccccc")}))
+	is.Equal(c.Size(), int64(30))
+	_, err = c.Get("b.txt")
+	is.True(errors.Is(err, fs.ErrNotExist))
+	_, err = c.Get("a.txt")
+	is.NoErr(err)
+	_, err = c.Get("c.txt")
+	is.NoErr(err)
+
+	// Too large to cache
+	is.NoErr(c.Set("d.txt", &virt.File{Path: "d.txt", Data: make([]byte, 100)}))
+	_, err = c.Get("d.txt")
+	is.True(errors.Is(err, fs.ErrNotExist))
+	is.Equal(c.Size(), int64(30))
+
+	// Overwriting an entry replaces its size
+	is.NoErr(c.Set("a.txt", &virt.File{Path: "a.txt", Data: []byte("a")}))
+	is.Equal(c.Size(), int64(26))
+}
+
+func TestLRUDelete(t *testing.T) {
+	is := is.New(t)
+	c := cache.LRU(1024)
+	is.NoErr(c.Set("dist/a.txt", &virt.File{Path: "dist/a.txt", Data: []byte("a")}))
+	is.NoErr(c.Set("dist/b.txt", &virt.File{Path: "dist/b.txt", Data: []byte("b")}))
+	is.NoErr(c.Link("dist/a.txt", "src/*.txt"))
+	is.NoErr(c.Delete("src/a.txt"))
+	_, err := c.Get("dist/a.txt")
+	is.True(errors.Is(err, fs.ErrNotExist))
+	_, err = c.Get("dist/b.txt")
+	is.NoErr(err)
+	is.Equal(c.Size(), int64(len("dist/b.txt")*2+1))
+}
+
+func TestLRUEvictLinks(t *testing.T) {
+	is := is.New(t)
+	c := cache.LRU(30)
+	// a.txt is generated from b.txt, which is generated from src.txt
+	is.NoErr(c.Link("a.txt", "b.txt"))
+	is.NoErr(c.Link("b.txt", "src.txt"))
+	is.NoErr(c.Set("b.txt", &virt.File{Path: "b.txt", Data: []byte("bbbbb")}))
+	is.NoErr(c.Set("a.txt", &virt.File{Path: "a.txt", Data: []byte("aaaaa")}))
+	// Evict b.txt
+	is.NoErr(c.Set("c.txt", &virt.File{Path: "c.txt", Data: []byte("ccccc")}))
+	_, err := c.Get("b.txt")
+	is.True(errors.Is(err, fs.ErrNotExist))
+	// Changing src.txt still reaches a.txt through the evicted b.txt
+	is.NoErr(c.Delete("src.txt"))
+	_, err = c.Get("a.txt")
+	is.True(errors.Is(err, fs.ErrNotExist))
+	_, err = c.Get("c.txt")
+	is.NoErr(err)
+}
+
+func TestConcurrentCaches(t *testing.T) {
+	caches := map[string]interface {
+		cache.Interface
+		cache.Deleter
+	}{
+		"memory": cache.Memory(),
+		"lru":    cache.LRU(512),
+	}
+	for name, c := range caches {
+		t.Run(name, func(t *testing.T) {
+			is := is.New(t)
+			var wg sync.WaitGroup
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					for j := 0; j < 100; j++ {
+						p := fmt.Sprintf("%d/%d.txt", i, j%10)
+						is.NoErr(c.Set(p, &virt.File{Path: p, Data: []byte(p)}))
+						c.Get(p)
+						is.NoErr(c.Link(p, "src.txt"))
+						if j%25 == 0 {
+							is.NoErr(c.Delete("src.txt"))
+						}
+					}
+				}(i)
+			}
+			wg.Wait()
+		})
+	}
+}
+
+func TestLinkIndex(t *testing.T) {
+	is := is.New(t)
+	c := cache.LRU(1024)
+	set := func(p string) {
+		is.NoErr(c.Set(p, &virt.File{Path: p}))
+	}
+	set("a.txt")
+	set("b.txt")
+	set("c.txt")
+	set("d.txt")
+	// c.txt <- b.txt <- a.txt, d.txt <- src/*.txt
+	is.NoErr(c.Link("a.txt", "b.txt"))
+	is.NoErr(c.Link("b.txt", "c.txt"))
+	is.NoErr(c.Link("d.txt", "src/*.txt"))
+	is.NoErr(c.Delete("c.txt"))
+	for _, p := range []string{"a.txt", "b.txt", "c.txt"} {
+		_, err := c.Get(p)
+		is.True(errors.Is(err, fs.ErrNotExist))
+	}
+	_, err := c.Get("d.txt")
+	is.NoErr(err)
+
+	// Evicted paths drop their links, so relinking starts over
+	set("a.txt")
+	is.NoErr(c.Delete("b.txt"))
+	_, err = c.Get("a.txt")
+	is.NoErr(err)
+	is.NoErr(c.Delete("src/d.txt"))
+	_, err = c.Get("d.txt")
+	is.True(errors.Is(err, fs.ErrNotExist))
+}
@@ -2,6 +2,7 @@ package cache
 
 import (
 	"io/fs"
+	"sync"
 
 	"github.com/matthewmueller/virt"
 )
@@ -10,17 +11,23 @@ import (
 func Memory() *Mem {
 	return &Mem{
 		files: map[string]*virt.File{},
-		links: map[string][]string{},
+		links: newLinks(),
 	}
 }
 
-// Mem is an in-memory cache.
+// Mem is an in-memory cache. It's safe for concurrent use.
 type Mem struct {
+	mu    sync.RWMutex
 	files map[string]*virt.File
-	links map[string][]string
+	links *links
 }
 
+var _ Interface = (*Mem)(nil)
+var _ Deleter = (*Mem)(nil)
+
 func (m *Mem) Get(path string) (*virt.File, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
 	if file, ok := m.files[path]; ok {
 		return file, nil
 	}
@@ -28,16 +35,36 @@ func (m *Mem) Get(path string) (*virt.File, error) {
 }
 
 func (m *Mem) Set(path string, file *virt.File) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.files[path] = file
 	return nil
 }
 
+// Link records that the file at from depends on each of the toPatterns paths.
+// Links accumulate across calls.
 func (m *Mem) Link(from string, toPatterns ...string) error {
-	m.links[from] = toPatterns
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.links.link(from, toPatterns...)
+	return nil
+}
+
+// Delete evicts the paths along with every file that transitively depends on
+// them.
+func (m *Mem) Delete(paths ...string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, path := range m.links.dependents(paths...) {
+		delete(m.files, path)
+		m.links.remove(path)
+	}
 	return nil
 }
 
 func (m *Mem) Clear() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
 	m.files = map[string]*virt.File{}
-	m.links = map[string][]string{}
+	m.links = newLinks()
 }
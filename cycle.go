@@ -0,0 +1,73 @@
+package genfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/matthewmueller/genfs/cache"
+	"github.com/matthewmueller/genfs/internal/tree"
+	"github.com/matthewmueller/virt"
+)
+
+// ErrCycle is returned when generators depend on each other's output
+var ErrCycle = errors.New("genfs: cycle")
+
+type generatingKey struct{}
+
+// generating returns the paths being generated by the open call, outermost
+// first
+func generating(ctx context.Context) []string {
+	chain, _ := ctx.Value(generatingKey{}).([]string)
+	return chain
+}
+
+// checkCycle returns an error if fpath is already being generated
+func (f *FileSystem) checkCycle(ctx context.Context, fpath string) (context.Context, error) {
+	chain := generating(ctx)
+	if i := slices.Index(chain, fpath); i >= 0 {
+		return ctx, f.cycleError(append(chain[i:len(chain):len(chain)], fpath))
+	}
+	return context.WithValue(ctx, generatingKey{}, append(chain[:len(chain):len(chain)], fpath)), nil
+}
+
+// cycleError returns an ErrCycle error describing the paths
+func (f *FileSystem) cycleError(paths []string) error {
+	cycle := make([]string, len(paths))
+	for i, p := range paths {
+		cycle[i] = f.rel(p)
+	}
+	return fmt.Errorf("%w %s", ErrCycle, strings.Join(cycle, " -> "))
+}
+
+// generate the match, detecting cycles between generators. A directory
+// generator that lists its own directory, or looks for a path within it, gets
+// the entries registered so far, since it's the one registering them. Any
+// other generator reading a directory that's still being generated would get
+// an incomplete listing, so that's reported as a cycle.
+func (f *FileSystem) generate(ctx context.Context, cache cache.Interface, match *tree.Match, target string) (*virt.File, error) {
+	if chain := generating(ctx); match.Mode.IsDir() && len(chain) > 0 && chain[len(chain)-1] == match.Path {
+		return match.Dir(), nil
+	}
+	ctx, err := f.checkCycle(ctx, match.Path)
+	if err != nil {
+		return nil, err
+	}
+	vfile, err := match.Generate(ctx, cache, target)
+	if err != nil {
+		return nil, f.treeError(err)
+	}
+	return vfile, nil
+}
+
+// treeError turns cycles detected by the tree into ErrCycle errors. Generators
+// waiting on each other from different goroutines can only be detected there.
+func (f *FileSystem) treeError(err error) error {
+	var cycle *tree.CycleError
+	if errors.As(err, &cycle) {
+		return f.cycleError(cycle.Paths)
+	}
+	return err
+}
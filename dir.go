@@ -1,7 +1,7 @@
 package genfs
 
 import (
-	"bytes"
+	"context"
 	"io/fs"
 	"path"
 
@@ -17,14 +17,34 @@ type Dir struct {
 	dir    string
 	mode   fs.FileMode
 	root   string
+	owner  string // cache path of the generated directory, if any
+	ctx    context.Context
+	params map[string]string
+	gen    *dirGenerator // generator of the directory, if any
+	limit  *childLimit   // limits the paths registered within the directory
+	gate   *gate         // closed once the directory's generator returns
+}
+
+// record a path registered within the directory, so it can be withdrawn along
+// with the directory's generator
+func (d *Dir) record(fpath string) {
+	if d.gen != nil {
+		d.gen.record(fpath)
+	}
+}
+
+// Context returns the context of the open call that's generating this
+// directory.
+func (d *Dir) Context() context.Context {
+	return d.ctx
 }
 
 func (d *Dir) Target() string {
-	return path.Join(d.root, d.target)
+	return path.Join(d.root, d.fsys.rel(d.target))
 }
 
 func (d *Dir) Path() string {
-	return d.dir
+	return d.fsys.rel(d.dir)
 }
 
 func (d *Dir) Mode() fs.FileMode {
@@ -35,56 +55,129 @@ func (d *Dir) Relative() string {
 	return relativePath(d.dir, d.target)
 }
 
-func (d *Dir) GenerateFile(relpath string, fn func(fsys FS, file *File) error) error {
-	return d.tree.GenerateFile(path.Join(d.dir, relpath), GeneratorFunc(func(cache cache.Interface, target string) (*virt.File, error) {
-		if cached, err := cache.Get(target); nil == err {
-			return cached, nil
-		}
-		file := &File{target, relpath, fs.FileMode(0), &bytes.Buffer{}, d.root}
-		fsys := scopedFS{d.fsys, cache, relpath}
-		if err := fn(fsys, file); err != nil {
-			return nil, err
-		}
-		vfile := &virt.File{
-			Path: relpath,
-			Mode: file.Mode(),
-			Data: file.data.Bytes(),
-		}
-		if err := cache.Set(target, vfile); err != nil {
-			return nil, err
-		}
-		return vfile, nil
-	}))
-}
-
-func (d *Dir) FileGenerator(relpath string, generator FileGenerator) error {
-	return d.GenerateFile(relpath, generator.GenerateFile)
-}
-
-func (d *Dir) GenerateDir(reldir string, fn func(fsys FS, dir *Dir) error) error {
-	reldir = path.Join(d.dir, reldir)
-	return d.tree.GenerateDir(reldir, GeneratorFunc(func(cache cache.Interface, target string) (*virt.File, error) {
-		if cached, err := cache.Get(reldir); nil == err {
-			return cached, nil
-		}
-		dir := &Dir{d.fsys, d.tree, target, reldir, fs.ModeDir, d.root}
-		fsys := scopedFS{d.fsys, cache, reldir}
-		if err := fn(fsys, dir); err != nil {
-			return nil, err
-		}
-		vdir := &virt.File{
-			Path: reldir,
-			Mode: dir.mode,
-			// Intentionally nil, filled in by the tree
-			Entries: nil,
-		}
-		if err := cache.Set(reldir, vdir); err != nil {
-			return nil, err
-		}
-		return vdir, nil
-	}))
-}
-
-func (d *Dir) DirGenerator(reldir string, generator DirGenerator) error {
-	return d.GenerateDir(reldir, generator.GenerateDir)
+// Param returns the value of the named parameter when the directory was
+// registered with a pattern like "pkg/{name}". It returns an empty string if
+// there's no such parameter.
+func (d *Dir) Param(name string) string {
+	return d.params[name]
+}
+
+func (d *Dir) GenerateFile(relpath string, fn func(fsys FS, file *File) error, options ...Option) error {
+	return d.generateFile(caller(1), relpath, fn, options)
+}
+
+func (d *Dir) FileGenerator(relpath string, generator FileGenerator, options ...Option) error {
+	return d.generateFile(caller(1), relpath, generator.GenerateFile, options)
+}
+
+func (d *Dir) generateFile(site, relpath string, fn func(fsys FS, file *File) error, options []Option) error {
+	fpath := path.Join(d.dir, relpath)
+	if err := d.gate.lock(fpath); err != nil {
+		return err
+	}
+	defer d.gate.unlock()
+	if err := d.limit.check(); err != nil {
+		return err
+	}
+	generator := &fileGenerator{
+		parent:  d,
+		path:    fpath,
+		site:    site,
+		fn:      fn,
+		options: options,
+	}
+	if err := d.tree.GenerateFile(fpath, generator); err != nil {
+		return err
+	}
+	d.limit.add()
+	d.record(fpath)
+	return nil
+}
+
+type fileGenerator struct {
+	parent  *Dir
+	path    string // registered path, which may be a pattern
+	site    string // where the generator was registered
+	fn      func(fsys FS, file *File) error
+	options []Option
+}
+
+func (g *fileGenerator) String() string {
+	return g.site
+}
+
+func (g *fileGenerator) Generate(ctx context.Context, cache cache.Interface, target string) (*virt.File, error) {
+	d := g.parent
+	return d.fsys.runFile(ctx, cache, target, fileRun{
+		reg:     registered{"file", g.path, g.site},
+		chain:   d.chain(),
+		options: g.options,
+		prepare: func(ctx context.Context) (*File, error) {
+			// Files matched by a pattern depend on the pattern, so removing the
+			// pattern evicts them
+			if target != g.path {
+				if err := cache.Link(target, g.path); err != nil {
+					return nil, err
+				}
+			}
+			// Files registered by a directory generator depend on that generator
+			if d.owner != "" {
+				if err := cache.Link(target, d.owner); err != nil {
+					return nil, err
+				}
+			}
+			var params map[string]string
+			if route, ok := tree.RouteOf(ctx); ok {
+				params = route.Params
+			}
+			return &File{
+				target: d.fsys.rel(target),
+				// Patterns are resolved by using the path relative to the target
+				path:   relativePath(d.dir, target),
+				root:   d.root,
+				params: params,
+			}, nil
+		},
+		fn: g.fn,
+	})
+}
+
+// GenerateDir registers a directory generator. Several generators can share a
+// directory, so the returned registration can be used to remove or replace
+// this one without affecting the others.
+func (d *Dir) GenerateDir(reldir string, fn func(fsys FS, dir *Dir) error, options ...Option) (*Registration, error) {
+	return d.generateDir(caller(1), reldir, fn, options)
+}
+
+func (d *Dir) DirGenerator(reldir string, generator DirGenerator, options ...Option) (*Registration, error) {
+	return d.generateDir(caller(1), reldir, generator.GenerateDir, options)
+}
+
+func (d *Dir) generateDir(site, reldir string, fn func(fsys FS, dir *Dir) error, options []Option) (*Registration, error) {
+	dpath := path.Join(d.dir, reldir)
+	if err := d.gate.lock(dpath); err != nil {
+		return nil, err
+	}
+	defer d.gate.unlock()
+	if err := d.limit.check(); err != nil {
+		return nil, err
+	}
+	generator := newDirGenerator(d, dpath, site, fn, options)
+	if err := d.tree.GenerateDir(dpath, generator); err != nil {
+		return nil, err
+	}
+	d.limit.add()
+	d.record(dpath)
+	return &Registration{generator}, nil
+}
+
+// Remove unregisters the generator at relpath within the directory. See
+// FileSystem.Remove for details.
+func (d *Dir) Remove(relpath string) error {
+	fpath := path.Join(d.dir, relpath)
+	if err := d.gate.lock(fpath); err != nil {
+		return err
+	}
+	defer d.gate.unlock()
+	return d.fsys.remove(fpath)
 }
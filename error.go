@@ -0,0 +1,140 @@
+package genfs
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"runtime/debug"
+)
+
+// GenerateError is returned when a generator fails. Use errors.As to inspect
+// it. When a generator fails because a file it read failed to generate, Err
+// wraps that file's GenerateError.
+type GenerateError struct {
+	Op     string  // operation that generated the target, e.g. "readdir", or empty
+	Target string  // path being generated
+	Path   string  // path the failing generator was registered at, may be a pattern
+	Chain  []Frame // generators that registered the failing generator, outermost first, ending with the failing generator
+	Err    error
+}
+
+// Frame describes a generator
+type Frame struct {
+	Path string // path the generator was registered at, may be a pattern
+	Site string // where the generator was registered, e.g. "blog/blog.go:42"
+}
+
+func (e *GenerateError) Error() string {
+	if len(e.Chain) == 0 {
+		return fmt.Sprintf("%s: error generating %q: %v", opPrefix(e.Op), e.Target, e.Err)
+	}
+	site := e.Chain[len(e.Chain)-1].Site
+	return fmt.Sprintf("%s: error generating %q (registered at %s): %v", opPrefix(e.Op), e.Target, site, e.Err)
+}
+
+// opPrefix returns the prefix of errors from the operation
+func opPrefix(op string) string {
+	if op == "" {
+		return "genfs"
+	}
+	return op
+}
+
+func (e *GenerateError) Unwrap() error {
+	return e.Err
+}
+
+// PanicError is returned when a generator panics. The stack trace is only
+// available through the Stack field to keep the message short.
+type PanicError struct {
+	Target string // path being generated
+	Value  any    // value passed to panic
+	Stack  []byte // stack trace of the panic
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("genfs: generator panicked while generating %q: %v", e.Target, e.Value)
+}
+
+// Unwrap returns the panic value if it's an error
+func (e *PanicError) Unwrap() error {
+	if err, ok := e.Value.(error); ok {
+		return err
+	}
+	return nil
+}
+
+// protect calls the generator's function, turning panics into a *PanicError
+// unless the filesystem should crash instead
+func (f *FileSystem) protect(target string, fn func() error) (err error) {
+	if f.CrashOnPanic {
+		return fn()
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			err = &PanicError{f.rel(target), r, debug.Stack()}
+		}
+	}()
+	return fn()
+}
+
+// chain returns the generators that registered the directory's generators,
+// outermost first
+func (d *Dir) chain() []Frame {
+	if d.gen == nil {
+		return nil
+	}
+	return append(d.gen.parent.chain(), Frame{d.fsys.rel(d.gen.path), d.gen.site})
+}
+
+// generateError wraps an error returned by the generator registered at fpath.
+// fs.ErrNotExist is left alone because it's not a failure.
+func (d *Dir) generateError(fpath, site, target string, err error) error {
+	return d.fsys.wrapGenerateError(d.chain(), fpath, site, target, err)
+}
+
+// wrapGenerateError wraps an error returned by the generator registered at
+// fpath from site. Chain lists the generators that registered it.
+// fs.ErrNotExist is left alone because it's not a failure.
+func (f *FileSystem) wrapGenerateError(chain []Frame, fpath, site, target string, err error) error {
+	if errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return &GenerateError{
+		Target: f.rel(target),
+		Path:   f.rel(fpath),
+		Chain:  append(chain, Frame{f.rel(fpath), site}),
+		Err:    err,
+	}
+}
+
+// generateError turns an error from generating the match during op into a
+// GenerateError
+func (f *FileSystem) generateError(op, matchPath, target string, err error) error {
+	var generateErr *GenerateError
+	if errors.As(err, &generateErr) {
+		// Wrapped errors and errors that already have the operation are left
+		// alone. Otherwise the error is copied because it may be shared with
+		// other callers of the generator.
+		if err != error(generateErr) || generateErr.Op == op {
+			return err
+		}
+		withOp := *generateErr
+		withOp.Op = op
+		return &withOp
+	}
+	// Cycles are reported where they're detected
+	if errors.Is(err, ErrCycle) {
+		return err
+	}
+	// Generators that don't exist aren't failures
+	if errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("%s: error generating %q: %w", opPrefix(op), target, err)
+	}
+	return &GenerateError{
+		Op:     op,
+		Target: f.rel(target),
+		Path:   f.rel(matchPath),
+		Err:    err,
+	}
+}
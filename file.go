@@ -2,8 +2,13 @@ package genfs
 
 import (
 	"bytes"
+	"context"
+	"fmt"
 	"io/fs"
 	"path"
+
+	"github.com/matthewmueller/genfs/cache"
+	"github.com/matthewmueller/virt"
 )
 
 type File struct {
@@ -12,6 +17,18 @@ type File struct {
 	mode   fs.FileMode
 	data   *bytes.Buffer
 	root   string
+	ctx    context.Context
+	params map[string]string
+	source string
+	max    int64 // maximum number of bytes that can be written
+	err    error // set when writing more than the maximum
+	gate   *gate // closed once the generator returns
+}
+
+// Context returns the context of the open call that's generating this file.
+// Long-running generators should stop when it's done.
+func (f *File) Context() context.Context {
+	return f.ctx
 }
 
 func (f *File) Target() string {
@@ -22,6 +39,19 @@ func (f *File) Path() string {
 	return f.path
 }
 
+// Param returns the value of the named parameter when the file was registered
+// with a pattern like "posts/{slug}.html". It returns an empty string if
+// there's no such parameter.
+func (f *File) Param(name string) string {
+	return f.params[name]
+}
+
+// Source returns the path of the file this file was transformed from, or an
+// empty string if the file wasn't generated by a transform.
+func (f *File) Source() string {
+	return f.source
+}
+
 func (f *File) Relative() string {
 	return "."
 }
@@ -31,13 +61,102 @@ func (f *File) Mode() fs.FileMode {
 }
 
 func (f *File) Write(p []byte) (n int, err error) {
+	if err := f.gate.lock(f.target); err != nil {
+		return 0, err
+	}
+	defer f.gate.unlock()
+	if err := f.grow(len(p)); err != nil {
+		return 0, err
+	}
 	return f.data.Write(p)
 }
 
 func (f *File) WriteString(s string) (n int, err error) {
+	if err := f.gate.lock(f.target); err != nil {
+		return 0, err
+	}
+	defer f.gate.unlock()
+	if err := f.grow(len(s)); err != nil {
+		return 0, err
+	}
 	return f.data.WriteString(s)
 }
 
+// grow checks that n more bytes can be written to the file
+func (f *File) grow(n int) error {
+	if f.err != nil {
+		return f.err
+	}
+	if f.max > 0 && int64(f.data.Len())+int64(n) > f.max {
+		f.err = fmt.Errorf("%w: %q is larger than %d bytes", ErrLimit, f.target, f.max)
+		return f.err
+	}
+	return nil
+}
+
 func (f *File) Read(p []byte) (n int, err error) {
+	if err := f.gate.lock(f.target); err != nil {
+		return 0, err
+	}
+	defer f.gate.unlock()
 	return f.data.Read(p)
 }
+
+// fileRun describes how to generate a file. File generators and transforms
+// share it, so caching, limits, logging, profiling and errors are handled the
+// same way for both.
+type fileRun struct {
+	reg     registered
+	chain   []Frame // generators that registered the generator, outermost first
+	options []Option
+	// prepare links the target to its inputs and returns the file to write to.
+	// It's only called when the file isn't cached.
+	prepare func(ctx context.Context) (*File, error)
+	fn      func(fsys FS, file *File) error
+}
+
+// runFile generates the target unless it's cached
+func (f *FileSystem) runFile(ctx context.Context, cache cache.Interface, target string, r fileRun) (*virt.File, error) {
+	if cached, err := cache.Get(target); nil == err {
+		f.recordCache(ctx, r.reg, target, true)
+		return cached, nil
+	}
+	f.recordCache(ctx, r.reg, target, false)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	limits := f.limits(r.options)
+	ctx, cancel := withTimeout(ctx, limits.Timeout)
+	defer cancel()
+	file, err := r.prepare(ctx)
+	if err != nil {
+		return nil, err
+	}
+	file.data = &bytes.Buffer{}
+	file.ctx = ctx
+	file.max = limits.MaxSize
+	file.gate = newGate()
+	fsys := scopedFS{ctx, f, cache, target}
+	handler := f.middleware.wrap(func(fsys FS, _ Output) error {
+		return r.fn(fsys, file)
+	})
+	err = f.run(ctx, r.reg, target, limits.Timeout, func() error { return handler(fsys, file) })
+	// Generators that ignored their timeout can't write to the file anymore
+	file.gate.close()
+	if err != nil {
+		return nil, f.wrapGenerateError(r.chain, r.reg.path, r.reg.site, target, err)
+	} else if file.err != nil {
+		// The generator ignored the error from writing too much
+		return nil, f.wrapGenerateError(r.chain, r.reg.path, r.reg.site, target, file.err)
+	}
+	vfile := &virt.File{
+		Path: file.path,
+		Mode: file.Mode(),
+		Data: file.data.Bytes(),
+	}
+	f.profile.produced(r.reg, len(vfile.Data))
+	if err := cache.Set(target, vfile); err != nil {
+		return nil, err
+	}
+	return vfile, nil
+}
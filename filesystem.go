@@ -1,10 +1,14 @@
 package genfs
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/fs"
+	"log/slog"
+	"path"
 	"sort"
+	"strings"
 
 	"github.com/matthewmueller/genfs/cache"
 	"github.com/matthewmueller/genfs/internal/tree"
@@ -16,59 +20,195 @@ type FileSystem struct {
 	tree  *tree.Tree
 	Root  string
 	Cache cache.Interface
+	// CrashOnPanic lets panics in generators crash the program. By default
+	// they're recovered and returned as a *PanicError.
+	CrashOnPanic bool
+	// Limits constrain the resources each generator can use. Registrations can
+	// override them with options.
+	Limits Limits
+	// Logger logs generator activity, cache lookups and how paths were
+	// resolved. Most records are logged at the debug level.
+	Logger *slog.Logger
+	base   string // path within the tree this filesystem is rooted at
+
+	transforms *transforms
+	middleware *middlewares
+	profile    *profiler
 }
 
 var _ fs.FS = (*FileSystem)(nil)
 var _ fs.ReadDirFS = (*FileSystem)(nil)
+var _ fs.StatFS = (*FileSystem)(nil)
+var _ fs.ReadFileFS = (*FileSystem)(nil)
+var _ fs.GlobFS = (*FileSystem)(nil)
+var _ fs.SubFS = (*FileSystem)(nil)
+
+// dir returns the directory that top-level generators are registered in
+func (f *FileSystem) dir() *Dir {
+	return &Dir{
+		fsys:   f,
+		tree:   f.tree,
+		target: f.base,
+		dir:    f.base,
+		mode:   fs.ModeDir,
+		root:   f.Root,
+		ctx:    context.Background(),
+	}
+}
+
+func (f *FileSystem) GenerateFile(relpath string, fn func(fsys FS, file *File) error, options ...Option) error {
+	return f.dir().generateFile(caller(1), relpath, fn, options)
+}
+
+func (f *FileSystem) FileGenerator(relpath string, generator FileGenerator, options ...Option) error {
+	return f.dir().generateFile(caller(1), relpath, generator.GenerateFile, options)
+}
+
+func (f *FileSystem) GenerateDir(reldir string, fn func(fsys FS, dir *Dir) error, options ...Option) (*Registration, error) {
+	return f.dir().generateDir(caller(1), reldir, fn, options)
+}
+
+func (f *FileSystem) DirGenerator(reldir string, generator DirGenerator, options ...Option) (*Registration, error) {
+	return f.dir().generateDir(caller(1), reldir, generator.GenerateDir, options)
+}
 
-func (f *FileSystem) GenerateFile(relpath string, fn func(fsys FS, file *File) error) error {
-	dir := &Dir{f, f.tree, relpath, ".", fs.ModeDir, f.Root}
-	return dir.GenerateFile(relpath, fn)
+// Invalidate evicts the paths from the cache along with every generated file
+// and directory that depends on them. The cache must implement cache.Deleter.
+func (f *FileSystem) Invalidate(paths ...string) error {
+	targets := make([]string, len(paths))
+	for i, p := range paths {
+		targets[i] = path.Join(f.base, p)
+	}
+	return f.evict(targets...)
+}
+
+// evict the paths and their dependents from the cache
+func (f *FileSystem) evict(paths ...string) error {
+	deleter, err := f.deleter()
+	if err != nil {
+		return err
+	}
+	return deleter.Delete(paths...)
+}
+
+// deleter returns the cache if it can evict paths. Check it before changing
+// the tree, so the tree isn't changed when the cache can't follow.
+func (f *FileSystem) deleter() (cache.Deleter, error) {
+	deleter, ok := f.Cache.(cache.Deleter)
+	if !ok {
+		return nil, fmt.Errorf("genfs: unable to evict from cache %T: %w", f.Cache, errors.ErrUnsupported)
+	}
+	return deleter, nil
 }
 
-func (f *FileSystem) FileGenerator(relpath string, generator FileGenerator) error {
-	dir := &Dir{f, f.tree, relpath, ".", fs.ModeDir, f.Root}
-	return dir.FileGenerator(relpath, generator)
+// Remove unregisters the generator at name along with every generator beneath
+// it and evicts their output from the cache. Filler directories left empty are
+// removed too. The fallback filesystem is never modified. Nothing is removed if
+// the cache doesn't implement cache.Deleter.
+func (f *FileSystem) Remove(name string) error {
+	target, err := f.path("remove", name)
+	if err != nil {
+		return err
+	}
+	return f.remove(target)
 }
 
-func (f *FileSystem) GenerateDir(reldir string, fn func(fsys FS, dir *Dir) error) error {
-	dir := &Dir{f, f.tree, reldir, ".", fs.ModeDir, f.Root}
-	return dir.GenerateDir(reldir, fn)
+func (f *FileSystem) remove(target string) error {
+	deleter, err := f.deleter()
+	if err != nil {
+		return err
+	}
+	removed := f.tree.Delete(target)
+	if removed == nil {
+		return &fs.PathError{
+			Op:   "remove",
+			Path: f.rel(target),
+			Err:  fs.ErrNotExist,
+		}
+	}
+	return deleter.Delete(removed...)
 }
 
-func (f *FileSystem) DirGenerator(reldir string, generator DirGenerator) error {
-	dir := &Dir{f, f.tree, reldir, ".", fs.ModeDir, f.Root}
-	return dir.DirGenerator(reldir, generator)
+// Sub returns a view of the filesystem rooted at dir. The view is itself a
+// *FileSystem that shares generators, transforms, middleware and the profile
+// with f, so anything registered through either is visible in both. The
+// view's settings (Cache, CrashOnPanic, Limits and Logger) are copied from f
+// when Sub is called, so configure f first. Afterwards the two are configured
+// separately: reads through the view use the view's Cache, and generators
+// registered through the view run with the view's settings. Its Root is dir
+// within f's Root, so targets are reported relative to the view.
+func (f *FileSystem) Sub(dir string) (fs.FS, error) {
+	base, err := f.path("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+	view := *f
+	view.Root = path.Join(f.Root, dir)
+	view.base = base
+	return &view, nil
+}
+
+// path checks that name is valid and returns its path within the tree
+func (f *FileSystem) path(op, name string) (string, error) {
+	if !fs.ValidPath(name) {
+		return "", &fs.PathError{
+			Op:   op,
+			Path: name,
+			Err:  fs.ErrInvalid,
+		}
+	}
+	return path.Join(f.base, name), nil
+}
+
+// rel returns the tree path relative to the filesystem's base
+func (f *FileSystem) rel(fpath string) string {
+	return relativePath(f.base, fpath)
 }
 
 func (f *FileSystem) Open(name string) (fs.File, error) {
-	return f.openWith(f.Cache, name)
+	return f.OpenContext(context.Background(), name)
 }
 
-func (f *FileSystem) openWith(cache cache.Interface, target string) (fs.File, error) {
-	return f.open(cache, "", target)
+// OpenContext opens the named file. The context is passed through to every
+// generator that runs, so cancelling it stops generation early.
+func (f *FileSystem) OpenContext(ctx context.Context, name string) (fs.File, error) {
+	target, err := f.path("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return f.open(ctx, f.Cache, target)
 }
 
 // ReadDir reads the named directory. We implement ReadDir in addition to Open
 // so that we can merge generated files with the fs.FS files that can later be
 // read by Open.
 func (f *FileSystem) ReadDir(name string) (des []fs.DirEntry, err error) {
-	return f.readDirWith(f.Cache, name)
+	return f.ReadDirContext(context.Background(), name)
+}
+
+// ReadDirContext reads the named directory. The context is passed through to
+// every generator that runs.
+func (f *FileSystem) ReadDirContext(ctx context.Context, name string) (des []fs.DirEntry, err error) {
+	target, err := f.path("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return f.readDir(ctx, f.Cache, target)
 }
 
-func (f *FileSystem) readDirWith(cache cache.Interface, name string) (entries []fs.DirEntry, err error) {
+func (f *FileSystem) readDir(ctx context.Context, cache cache.Interface, name string) (entries []fs.DirEntry, err error) {
 	found := false
 
 	// First try finding an exact match, generate the directory, and append its
 	// entries
 	if match, ok := f.tree.Find(name); ok && match.Mode.IsDir() {
-		if vfile, err := match.Generate(cache, name); err == nil {
+		if vfile, err := f.generate(ctx, cache, match, name); err == nil {
 			for _, entry := range vfile.Entries {
-				entries = append(entries, wrapEntry(f, entry))
+				entries = append(entries, wrapEntry(ctx, f, cache, entry))
 			}
 			found = true
 		} else if !errors.Is(err, fs.ErrNotExist) {
-			return nil, fmt.Errorf("readdir: error generating directory %q: %w", name, err)
+			return nil, f.generateError("readdir", match.Path, name, err)
 		}
 	}
 
@@ -76,6 +216,7 @@ func (f *FileSystem) readDirWith(cache cache.Interface, name string) (entries []
 	// entries
 	if des, err := fs.ReadDir(f.fsys, name); err == nil {
 		entries = append(entries, des...)
+		entries = append(entries, f.transformEntries(ctx, cache, name, des)...)
 		found = true
 	} else if !errors.Is(err, fs.ErrNotExist) {
 		return nil, fmt.Errorf("readdir: error reading directory %q: %w", name, err)
@@ -104,41 +245,241 @@ func dirEntrySet(entries []fs.DirEntry) (des []fs.DirEntry) {
 	return des
 }
 
-func (f *FileSystem) open(cache cache.Interface, previous, target string) (fs.File, error) {
-	// Check that target is valid
-	if !fs.ValidPath(target) {
+func (f *FileSystem) open(ctx context.Context, cache cache.Interface, target string) (fs.File, error) {
+	var file fs.File
+	vfile, err := f.find(ctx, cache, "", target, func(target string) (err error) {
+		file, err = f.fsys.Open(target)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	} else if vfile == nil {
+		return wrapFile(ctx, f, target, file), nil
+	}
+	return wrapFile(ctx, f, target, virt.Open(vfile)), nil
+}
+
+// Stat returns a FileInfo describing the named file. Directories are described
+// without running the generators of the files within them. Files are
+// described from the cache when possible, otherwise their generator needs to
+// run to know whether the file exists and how large it is.
+func (f *FileSystem) Stat(name string) (fs.FileInfo, error) {
+	target, err := f.path("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return f.stat(context.Background(), f.Cache, target)
+}
+
+func (f *FileSystem) stat(ctx context.Context, cache cache.Interface, target string) (fs.FileInfo, error) {
+	var info fs.FileInfo
+	vfile, err := f.find(ctx, cache, "", target, func(target string) (err error) {
+		info, err = fs.Stat(f.fsys, target)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	} else if vfile == nil {
+		return info, nil
+	}
+	return vfile.Info()
+}
+
+// ReadFile reads the named file. Generated files are copied straight out of
+// the generator's output and fallback files are read with fs.ReadFile.
+func (f *FileSystem) ReadFile(name string) ([]byte, error) {
+	target, err := f.path("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	return f.readFile(context.Background(), f.Cache, target)
+}
+
+func (f *FileSystem) readFile(ctx context.Context, cache cache.Interface, target string) ([]byte, error) {
+	var data []byte
+	vfile, err := f.find(ctx, cache, "", target, func(target string) (err error) {
+		data, err = fs.ReadFile(f.fsys, target)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	} else if vfile == nil {
+		return data, nil
+	} else if vfile.Mode.IsDir() {
 		return nil, &fs.PathError{
-			Op:   "open",
+			Op:   "read",
 			Path: target,
 			Err:  fs.ErrInvalid,
 		}
 	}
+	// Callers are allowed to modify the result, so copy it out of the cache
+	data = make([]byte, len(vfile.Data))
+	copy(data, vfile.Data)
+	return data, nil
+}
+
+// Glob returns the names of all files matching pattern, merging generated
+// files with files from the fallback filesystem. Directory generators only run
+// when their path could match the pattern and file generators never run.
+func (f *FileSystem) Glob(pattern string) ([]string, error) {
+	return f.glob(context.Background(), f.Cache, pattern)
+}
+
+func (f *FileSystem) glob(ctx context.Context, cache cache.Interface, pattern string) ([]string, error) {
+	// Check that the pattern is valid
+	if _, err := path.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	targets, err := f.globTree(ctx, cache, f.base, strings.Split(pattern, "/"))
+	if err != nil {
+		return nil, err
+	}
+	fsys := f.fsys
+	if f.base != "." {
+		if fsys, err = fs.Sub(f.fsys, f.base); err != nil {
+			return nil, err
+		}
+	}
+	fallback, err := fs.Glob(fsys, pattern)
+	if err != nil {
+		return nil, fmt.Errorf("genfs: error globbing %q: %w", pattern, err)
+	}
+	transformed, err := f.globTransforms(fsys, pattern)
+	if err != nil {
+		return nil, fmt.Errorf("genfs: error globbing %q: %w", pattern, err)
+	}
+	fallback = append(fallback, transformed...)
+	seen := map[string]bool{}
+	matches := make([]string, 0, len(targets)+len(fallback))
+	for _, target := range targets {
+		match := f.rel(target)
+		seen[match] = true
+		matches = append(matches, match)
+	}
+	for _, match := range fallback {
+		if !seen[match] {
+			seen[match] = true
+			matches = append(matches, match)
+		}
+	}
+	sort.Strings(matches)
+	return matches, nil
+}
 
-	// First try finding an exact match
+// globTransforms matches the pattern against the files transformed from the
+// fallback filesystem, which is rooted at the filesystem's base
+func (f *FileSystem) globTransforms(fsys fs.FS, pattern string) (matches []string, err error) {
+	transforms := f.transforms.all()
+	if len(transforms) == 0 {
+		return nil, nil
+	}
+	dir, name := path.Split(pattern)
+	dirs := []string{"."}
+	if dir != "" {
+		if dirs, err = fs.Glob(fsys, path.Clean(dir)); err != nil {
+			return nil, err
+		}
+	}
+	for _, dir := range dirs {
+		des, err := fs.ReadDir(fsys, dir)
+		if err != nil {
+			// Not a directory
+			continue
+		}
+		for _, de := range des {
+			if de.IsDir() {
+				continue
+			}
+			for _, t := range transforms {
+				target, ok := t.target(path.Join(f.base, dir, de.Name()))
+				if !ok {
+					continue
+				}
+				if ok, _ := path.Match(name, path.Base(target)); ok {
+					matches = append(matches, f.rel(target))
+				}
+			}
+		}
+	}
+	return matches, nil
+}
+
+// globTree matches the pattern segments against the entries of the generated
+// directory, generating subdirectories as they match.
+func (f *FileSystem) globTree(ctx context.Context, cache cache.Interface, dir string, segments []string) (matches []string, err error) {
+	match, ok := f.tree.Find(dir)
+	if !ok || !match.Mode.IsDir() {
+		return nil, nil
+	}
+	vfile, err := f.generate(ctx, cache, match, dir)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, f.generateError("", match.Path, dir, err)
+	}
+	for _, entry := range vfile.Entries {
+		if ok, _ := path.Match(segments[0], entry.Name()); !ok {
+			continue
+		}
+		if len(segments) == 1 {
+			matches = append(matches, entry.Path)
+			continue
+		} else if !entry.IsDir() {
+			continue
+		}
+		subMatches, err := f.globTree(ctx, cache, entry.Path, segments[1:])
+		if err != nil {
+			return nil, err
+		}
+		matches = append(matches, subMatches...)
+	}
+	return matches, nil
+}
+
+// find the generated file for target. When the file should be read from the
+// fallback filesystem instead, find calls fallback and returns a nil file if
+// fallback succeeds.
+func (f *FileSystem) find(ctx context.Context, cache cache.Interface, previous, target string, fallback func(target string) error) (*virt.File, error) {
+	// First try finding an exact match. Directories with a rest parameter match
+	// every path beneath them, but the path may be a file that the directory one
+	// segment up generates, so only match them once that directory has been
+	// generated.
 	match, ok := f.tree.Find(target)
+	if ok && match.Nested() && previous != path.Dir(target) {
+		ok = false
+	}
 	if ok && match.Mode.IsGen() {
-		if vfile, err := match.Generate(cache, target); err == nil {
-			return wrapFile(f, vfile.Path, virt.Open(vfile)), nil
+		if vfile, err := f.generate(ctx, cache, match, target); err == nil {
+			return vfile, nil
 		} else if !errors.Is(err, fs.ErrNotExist) {
-			return nil, fmt.Errorf("genfs: error generating %q: %w", target, err)
+			return nil, f.generateError("", match.Path, target, err)
 		}
 	}
 
-	// Next try opening the file from the fallback filesystem
-	if file, err := f.fsys.Open(target); err == nil {
-		return wrapFile(f, target, file), nil
+	// Next try the fallback filesystem
+	if err := fallback(target); err == nil {
+		f.log(ctx, slog.LevelDebug, "genfs: found in fallback", "path", f.rel(target))
+		return nil, nil
 	} else if !errors.Is(err, fs.ErrNotExist) {
 		return nil, fmt.Errorf("genfs: error opening %q: %w", target, err)
 	}
 
+	// Next try transforming a file from the fallback filesystem
+	if vfile, err := f.transform(ctx, cache, target); err == nil {
+		return vfile, nil
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
 	// Next, if we did find a match above, but it's not a generator, it must be
 	// a filler directory, so return it now
 	if ok && match.Mode.IsDir() {
-		vfile, err := match.Generate(cache, target)
+		vfile, err := f.generate(ctx, cache, match, target)
 		if err != nil {
-			return nil, fmt.Errorf("genfs: error generating directory %q: %w", target, err)
+			return nil, f.generateError("", match.Path, target, err)
 		}
-		return wrapFile(f, vfile.Path, virt.Open(vfile)), nil
+		return vfile, nil
 	}
 
 	// Lastly, try finding a node by its prefix. We only allow directory
@@ -146,19 +487,21 @@ func (f *FileSystem) open(cache cache.Interface, previous, target string) (fs.Fi
 	// end up matching.
 	match, ok = f.tree.FindPrefix(target)
 	if !ok || !match.Mode.IsGenDir() {
+		f.log(ctx, slog.LevelDebug, "genfs: not found", "path", f.rel(target), "reason", "no generator or fallback file")
 		return nil, fmt.Errorf("genfs: %q %w", target, fs.ErrNotExist)
 	}
 
 	// Ignore the generated file, because this isn't an exact match anyway
-	if _, err := match.Generate(cache, target); err != nil {
-		return nil, fmt.Errorf("genfs: error generating directory %q: %w", target, err)
+	if _, err := f.generate(ctx, cache, match, target); err != nil {
+		return nil, f.generateError("", match.Path, target, err)
 	}
 
 	// If we're not making progress, return an error
 	if match.Path == previous {
+		f.log(ctx, slog.LevelDebug, "genfs: not found", "path", f.rel(target), "reason", fmt.Sprintf("directory generator %q didn't generate it", f.rel(match.Path)))
 		return nil, fmt.Errorf("genfs: %q: %w", target, fs.ErrNotExist)
 	}
 
 	// Now that the directory has been generated, try again
-	return f.open(cache, match.Path, target)
+	return f.find(ctx, cache, match.Path, target, fallback)
 }
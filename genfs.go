@@ -19,6 +19,8 @@ type DirGenerator interface {
 	GenerateDir(fsys FS, dir *Dir) error
 }
 
+// Deprecated: GeneratorFunc isn't used by genfs anymore. Use GenerateFile or
+// GenerateDir instead.
 type GeneratorFunc func(cache cache.Interface, target string) (*virt.File, error)
 
 func (fn GeneratorFunc) Generate(cache cache.Interface, target string) (*virt.File, error) {
@@ -26,15 +28,23 @@ func (fn GeneratorFunc) Generate(cache cache.Interface, target string) (*virt.Fi
 }
 
 func New(fsys fs.FS) *FileSystem {
-	return &FileSystem{fsys, tree.New(), ".", cache.Discard()}
+	return &FileSystem{
+		fsys:       fsys,
+		tree:       tree.New(),
+		Root:       ".",
+		Cache:      cache.Discard(),
+		base:       ".",
+		transforms: &transforms{},
+		middleware: &middlewares{},
+		profile:    newProfiler(),
+	}
 }
 
 func relativePath(base, target string) string {
-	rel := strings.TrimPrefix(target, base)
-	if rel == "" {
+	if base == "." {
+		return target
+	} else if target == base {
 		return "."
-	} else if rel[0] == '/' {
-		rel = rel[1:]
 	}
-	return rel
+	return strings.TrimPrefix(target, base+"/")
 }
@@ -1,15 +1,23 @@
 package genfs_test
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/fs"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/fstest"
 	"time"
@@ -1336,3 +1344,1944 @@ func TestCacheWalk(t *testing.T) {
 	is.Equal(len(called), 1)
 	is.Equal(called["dist"], 1)
 }
+
+type linkCache struct {
+	cache.Interface
+	links map[string][]string
+}
+
+func (c *linkCache) Link(from string, to ...string) error {
+	c.links[from] = append(c.links[from], to...)
+	return c.Interface.Link(from, to...)
+}
+
+func TestCacheLink(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{
+		"a.txt":     "a",
+		"src/b.txt": "b",
+	})
+	links := &linkCache{cache.Memory(), map[string][]string{}}
+	fsys.Cache = links
+	fsys.GenerateFile("dist/a.txt", func(fsys genfs.FS, file *genfs.File) error {
+		code, err := fs.ReadFile(fsys, "a.txt")
+		if err != nil {
+			return err
+		}
+		file.Write(code)
+		return nil
+	})
+	fsys.GenerateDir("dist/src", func(fsys genfs.FS, dir *genfs.Dir) error {
+		des, err := fs.ReadDir(fsys, "src")
+		if err != nil {
+			return err
+		}
+		for _, de := range des {
+			if _, err := fs.Stat(fsys, path.Join("src", de.Name())); err != nil {
+				return err
+			}
+			dir.GenerateFile(de.Name(), func(fsys genfs.FS, file *genfs.File) error {
+				return nil
+			})
+		}
+		return nil
+	})
+	code, err := fs.ReadFile(fsys, "dist/a.txt")
+	is.NoErr(err)
+	is.Equal(string(code), "a")
+	is.Equal(links.links["dist/a.txt"], []string{"a.txt"})
+	des, err := fs.ReadDir(fsys, "dist/src")
+	is.NoErr(err)
+	is.Equal(len(des), 1)
+	is.Equal(links.links["dist/src"], []string{"src", "src/b.txt"})
+	// Cached reads don't relink
+	code, err = fs.ReadFile(fsys, "dist/a.txt")
+	is.NoErr(err)
+	is.Equal(string(code), "a")
+	is.Equal(links.links["dist/a.txt"], []string{"a.txt"})
+}
+
+func TestCacheRestart(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+	dirCalled := 0
+	fileCalled := 0
+	start := func() (*genfs.FileSystem, *cache.Disk) {
+		c, err := cache.Dir(dir)
+		is.NoErr(err)
+		fsys := genfs.New(virt.Map{})
+		fsys.Cache = c
+		// Generators sharing a directory and a site are still cached separately
+		for _, name := range []string{"a.txt", "b.txt"} {
+			_, err := fsys.GenerateDir("dist", func(fsys genfs.FS, dir *genfs.Dir) error {
+				dirCalled++
+				return dir.GenerateFile(name, func(fsys genfs.FS, file *genfs.File) error {
+					fileCalled++
+					file.WriteString(name)
+					return nil
+				})
+			})
+			is.NoErr(err)
+		}
+		return fsys, c
+	}
+	entries := func() int {
+		des, err := os.ReadDir(filepath.Join(dir, "files"))
+		is.NoErr(err)
+		return len(des)
+	}
+
+	fsys, c := start()
+	des, err := fs.ReadDir(fsys, "dist")
+	is.NoErr(err)
+	is.Equal(len(des), 2)
+	code, err := fs.ReadFile(fsys, "dist/b.txt")
+	is.NoErr(err)
+	is.Equal(string(code), "b.txt")
+	is.Equal(dirCalled, 2)
+	is.Equal(fileCalled, 1)
+	is.NoErr(c.Close())
+	before := entries()
+
+	// Directory generators run once per process to register their files, but
+	// they reuse their cache entries and the files they registered stay cached
+	fsys, c = start()
+	des, err = fs.ReadDir(fsys, "dist")
+	is.NoErr(err)
+	is.Equal(len(des), 2)
+	code, err = fs.ReadFile(fsys, "dist/b.txt")
+	is.NoErr(err)
+	is.Equal(string(code), "b.txt")
+	is.Equal(dirCalled, 4)
+	is.Equal(fileCalled, 1)
+	is.NoErr(c.Close())
+	is.Equal(entries(), before)
+}
+
+func TestInvalidate(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{
+		"a.txt": "a",
+		"b.txt": "b",
+		"c.txt": "c",
+	})
+	fsys.Cache = cache.Memory()
+	called := map[string]int{}
+	fsys.GenerateFile("dist/a.txt", func(fsys genfs.FS, file *genfs.File) error {
+		called[file.Target()]++
+		code, err := fs.ReadFile(fsys, "c.txt")
+		if err != nil {
+			return err
+		}
+		file.Write(code)
+		return nil
+	})
+	fsys.GenerateDir("dist/b", func(fsys genfs.FS, dir *genfs.Dir) error {
+		called[dir.Path()]++
+		dir.GenerateFile("index.txt", func(fsys genfs.FS, file *genfs.File) error {
+			called[file.Target()]++
+			code, err := fs.ReadFile(fsys, "b.txt")
+			if err != nil {
+				return err
+			}
+			file.Write(code)
+			return nil
+		})
+		return nil
+	})
+	read := func() {
+		code, err := fs.ReadFile(fsys, "dist/a.txt")
+		is.NoErr(err)
+		is.Equal(string(code), "c")
+		code, err = fs.ReadFile(fsys, "dist/b/index.txt")
+		is.NoErr(err)
+		is.Equal(string(code), "b")
+	}
+	read()
+	is.Equal(called["dist/a.txt"], 1)
+	is.Equal(called["dist/b"], 1)
+	is.Equal(called["dist/b/index.txt"], 1)
+
+	// Unrelated paths don't evict anything
+	is.NoErr(fsys.Invalidate("a.txt"))
+	read()
+	is.Equal(called["dist/a.txt"], 1)
+	is.Equal(called["dist/b"], 1)
+	is.Equal(called["dist/b/index.txt"], 1)
+
+	// Dependents are evicted
+	is.NoErr(fsys.Invalidate("c.txt"))
+	read()
+	is.Equal(called["dist/a.txt"], 2)
+	is.Equal(called["dist/b"], 1)
+	is.Equal(called["dist/b/index.txt"], 1)
+	is.NoErr(fsys.Invalidate("b.txt"))
+	read()
+	is.Equal(called["dist/a.txt"], 2)
+	is.Equal(called["dist/b"], 1)
+	is.Equal(called["dist/b/index.txt"], 2)
+
+	// Files generated by a directory are evicted along with the directory
+	is.NoErr(fsys.Invalidate("dist/b"))
+	read()
+	is.Equal(called["dist/a.txt"], 2)
+	is.Equal(called["dist/b"], 1)
+	is.Equal(called["dist/b/index.txt"], 3)
+	des, err := fs.ReadDir(fsys, "dist/b")
+	is.NoErr(err)
+	is.Equal(len(des), 1)
+	is.Equal(called["dist/b"], 2)
+}
+
+// getSetCache is a cache that doesn't implement cache.Deleter
+type getSetCache struct {
+	cache.Interface
+}
+
+func TestInvalidateUnsupported(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{})
+	fsys.Cache = getSetCache{cache.Memory()}
+	err := fsys.Invalidate("a.txt")
+	is.True(errors.Is(err, errors.ErrUnsupported))
+
+	// Generators are left in place when their output can't be evicted
+	fsys.GenerateFile("a.txt", func(fsys genfs.FS, file *genfs.File) error {
+		file.WriteString("a")
+		return nil
+	})
+	reg, err := fsys.GenerateDir("b", func(fsys genfs.FS, dir *genfs.Dir) error {
+		return nil
+	})
+	is.NoErr(err)
+	err = fsys.Remove("a.txt")
+	is.True(errors.Is(err, errors.ErrUnsupported))
+	err = reg.Remove()
+	is.True(errors.Is(err, errors.ErrUnsupported))
+	err = reg.Replace(func(fsys genfs.FS, dir *genfs.Dir) error {
+		return nil
+	})
+	is.True(errors.Is(err, errors.ErrUnsupported))
+	code, err := fs.ReadFile(fsys, "a.txt")
+	is.NoErr(err)
+	is.Equal(string(code), "a")
+	_, err = fs.ReadDir(fsys, "b")
+	is.NoErr(err)
+
+	// Once the cache supports evicting, they can be removed
+	fsys.Cache = cache.Memory()
+	is.NoErr(fsys.Remove("a.txt"))
+	is.NoErr(reg.Remove())
+	_, err = fs.ReadFile(fsys, "a.txt")
+	is.True(errors.Is(err, fs.ErrNotExist))
+}
+
+func TestConcurrentReadFile(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{
+		"src/a.txt": "a",
+	})
+	fsys.Cache = cache.Memory()
+	fsys.GenerateFile("a.txt", func(fsys genfs.FS, file *genfs.File) error {
+		code, err := fs.ReadFile(fsys, "src/a.txt")
+		if err != nil {
+			return err
+		}
+		file.Write(code)
+		return nil
+	})
+	fsys.GenerateDir("dist", func(fsys genfs.FS, dir *genfs.Dir) error {
+		for i := 0; i < 4; i++ {
+			i := i
+			_, err := dir.GenerateDir(fmt.Sprintf("%d", i), func(fsys genfs.FS, dir *genfs.Dir) error {
+				for j := i; j < 32; j += 4 {
+					err := dir.GenerateFile(fmt.Sprintf("%d.txt", j), func(fsys genfs.FS, file *genfs.File) error {
+						file.WriteString(file.Target())
+						return nil
+					})
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			target := fmt.Sprintf("dist/%d/%d.txt", i%4, i)
+			code, err := fs.ReadFile(fsys, target)
+			is.NoErr(err)
+			is.Equal(string(code), target)
+			code, err = fs.ReadFile(fsys, "a.txt")
+			is.NoErr(err)
+			is.Equal(string(code), "a")
+			_, err = fs.ReadDir(fsys, "dist")
+			is.NoErr(err)
+			err = fs.WalkDir(fsys, ".", func(path string, d fs.DirEntry, err error) error {
+				return err
+			})
+			is.NoErr(err)
+		}(i)
+	}
+	wg.Wait()
+	des, err := fs.ReadDir(fsys, "dist")
+	is.NoErr(err)
+	is.Equal(len(des), 4)
+}
+
+func TestConcurrentRegister(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{})
+	var wg sync.WaitGroup
+	for i := 0; i < 32; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			target := fmt.Sprintf("dist/%d.txt", i)
+			is.NoErr(fsys.GenerateFile(target, func(fsys genfs.FS, file *genfs.File) error {
+				file.WriteString(file.Target())
+				return nil
+			}))
+			code, err := fs.ReadFile(fsys, target)
+			is.NoErr(err)
+			is.Equal(string(code), target)
+			_, err = fs.ReadDir(fsys, "dist")
+			is.NoErr(err)
+		}(i)
+	}
+	wg.Wait()
+	des, err := fs.ReadDir(fsys, "dist")
+	is.NoErr(err)
+	is.Equal(len(des), 32)
+}
+
+// waitingContext signals every time a caller waits on it to be done
+type waitingContext struct {
+	context.Context
+	waiting chan<- struct{}
+}
+
+func (c waitingContext) Done() <-chan struct{} {
+	c.waiting <- struct{}{}
+	return c.Context.Done()
+}
+
+func TestConcurrentGenerateOnce(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{})
+	var called atomic.Int32
+	release := make(chan struct{})
+	fsys.GenerateFile("a.txt", func(fsys genfs.FS, file *genfs.File) error {
+		called.Add(1)
+		<-release
+		file.WriteString("a")
+		return nil
+	})
+	fsys.GenerateFile("b.txt", func(fsys genfs.FS, file *genfs.File) error {
+		called.Add(1)
+		<-release
+		return errors.New("unable to generate b.txt")
+	})
+	// Readers that find a generator already running wait on their context
+	// alongside it
+	waiting := make(chan struct{}, 32)
+	ctx := waitingContext{context.Background(), waiting}
+	read := func(name string) ([]byte, error) {
+		file, err := fsys.OpenContext(ctx, name)
+		if err != nil {
+			return nil, err
+		}
+		defer file.Close()
+		return io.ReadAll(file)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			code, err := read("a.txt")
+			is.NoErr(err)
+			is.Equal(string(code), "a")
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := read("b.txt")
+			is.True(err != nil)
+			is.True(strings.Contains(err.Error(), "unable to generate b.txt"))
+		}()
+	}
+	// Wait for every reader but the two running the generators to be waiting
+	// before releasing the generators
+	for i := 0; i < 30; i++ {
+		<-waiting
+	}
+	close(release)
+	wg.Wait()
+	is.Equal(called.Load(), int32(2))
+
+	// Later reads run the generator again
+	code, err := fs.ReadFile(fsys, "a.txt")
+	is.NoErr(err)
+	is.Equal(string(code), "a")
+	is.Equal(called.Load(), int32(3))
+}
+
+type ctxKey struct{}
+
+func TestOpenContext(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{})
+	called := 0
+	fsys.GenerateFile("slow.txt", func(fsys genfs.FS, file *genfs.File) error {
+		called++
+		<-file.Context().Done()
+		return file.Context().Err()
+	})
+	fsys.GenerateFile("a.txt", func(fsys genfs.FS, file *genfs.File) error {
+		called++
+		file.WriteString(file.Context().Value(ctxKey{}).(string))
+		return nil
+	})
+	fsys.GenerateDir("dist", func(fsys genfs.FS, dir *genfs.Dir) error {
+		called++
+		value := dir.Context().Value(ctxKey{}).(string)
+		return dir.GenerateFile("b.txt", func(fsys genfs.FS, file *genfs.File) error {
+			called++
+			code, err := fs.ReadFile(fsys, "a.txt")
+			if err != nil {
+				return err
+			}
+			file.WriteString(value + string(code))
+			return nil
+		})
+	})
+
+	// Deadlines stop slow generators
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	_, err := fsys.OpenContext(ctx, "slow.txt")
+	is.True(errors.Is(err, context.DeadlineExceeded))
+	is.Equal(called, 1)
+
+	// Cancelled contexts don't run generators
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = fsys.OpenContext(ctx, "a.txt")
+	is.True(errors.Is(err, context.Canceled))
+	is.Equal(called, 1)
+	_, err = fsys.ReadDirContext(ctx, "dist")
+	is.True(errors.Is(err, context.Canceled))
+	is.Equal(called, 1)
+
+	// Context flows through to nested generators
+	ctx = context.WithValue(context.Background(), ctxKey{}, "a")
+	file, err := fsys.OpenContext(ctx, "dist/b.txt")
+	is.NoErr(err)
+	defer file.Close()
+	code, err := io.ReadAll(file)
+	is.NoErr(err)
+	is.Equal(string(code), "aa")
+	is.Equal(called, 4)
+
+	// Reading an open directory uses the context it was opened with
+	ctx, cancel = context.WithCancel(context.Background())
+	ctx = context.WithValue(ctx, ctxKey{}, "a")
+	dir, err := fsys.OpenContext(ctx, "dist")
+	is.NoErr(err)
+	defer dir.Close()
+	is.Equal(called, 5)
+	cancel()
+	_, err = dir.(fs.ReadDirFile).ReadDir(-1)
+	is.True(errors.Is(err, context.Canceled))
+	is.Equal(called, 5)
+}
+
+func TestSync(t *testing.T) {
+	is := is.New(t)
+	dir := t.TempDir()
+	fallback := virt.Map{
+		"public/favicon.ico": "favicon",
+		"public/robots.txt":  "robots",
+	}
+	fsys := genfs.New(fallback)
+	fsys.GenerateDir("pages", func(fsys genfs.FS, dir *genfs.Dir) error {
+		return dir.GenerateFile("index.html", func(fsys genfs.FS, file *genfs.File) error {
+			file.WriteString("<h1>index</h1>")
+			return nil
+		})
+	})
+	version := "1"
+	fsys.GenerateFile("version.txt", func(fsys genfs.FS, file *genfs.File) error {
+		file.WriteString(version)
+		return nil
+	})
+	is.NoErr(os.WriteFile(filepath.Join(dir, "user.txt"), []byte("user"), 0644))
+	is.NoErr(genfs.Sync(fsys, dir))
+	readFile := func(name string) string {
+		code, err := os.ReadFile(filepath.Join(dir, name))
+		is.NoErr(err)
+		return string(code)
+	}
+	is.Equal(readFile("pages/index.html"), "<h1>index</h1>")
+	is.Equal(readFile("public/favicon.ico"), "favicon")
+	is.Equal(readFile("public/robots.txt"), "robots")
+	is.Equal(readFile("version.txt"), "1")
+	is.Equal(readFile("user.txt"), "user")
+
+	// Backdate the files, so we can tell which ones were rewritten
+	past := time.Now().Add(-time.Hour).Truncate(time.Second)
+	for _, name := range []string{"pages/index.html", "public/robots.txt", "version.txt"} {
+		is.NoErr(os.Chtimes(filepath.Join(dir, name), past, past))
+	}
+	modTime := func(name string) time.Time {
+		stat, err := os.Stat(filepath.Join(dir, name))
+		is.NoErr(err)
+		return stat.ModTime()
+	}
+
+	version = "2"
+	delete(fallback, "public/favicon.ico")
+	is.NoErr(genfs.Sync(fsys, dir))
+	is.Equal(readFile("pages/index.html"), "<h1>index</h1>")
+	is.Equal(modTime("pages/index.html"), past)
+	is.Equal(modTime("public/robots.txt"), past)
+	is.Equal(readFile("version.txt"), "2")
+	is.True(modTime("version.txt") != past)
+	_, err := os.Stat(filepath.Join(dir, "public/favicon.ico"))
+	is.True(errors.Is(err, fs.ErrNotExist))
+	is.Equal(readFile("user.txt"), "user")
+
+	// Stale directories are removed too
+	delete(fallback, "public/robots.txt")
+	is.NoErr(genfs.Sync(fsys, dir))
+	_, err = os.Stat(filepath.Join(dir, "public"))
+	is.True(errors.Is(err, fs.ErrNotExist))
+	is.Equal(readFile("version.txt"), "2")
+
+	// Files can turn into directories
+	fallback["a"] = "a"
+	fallback["b"] = "b"
+	is.NoErr(genfs.Sync(fsys, dir))
+	is.Equal(readFile("a"), "a")
+	is.Equal(readFile("b"), "b")
+	delete(fallback, "a")
+	delete(fallback, "b")
+	fallback["a/x.txt"] = "x"
+	fsys.GenerateDir("b", func(fsys genfs.FS, dir *genfs.Dir) error {
+		return nil
+	})
+	is.NoErr(genfs.Sync(fsys, dir))
+	is.Equal(readFile("a/x.txt"), "x")
+	stat, err := os.Stat(filepath.Join(dir, "b"))
+	is.NoErr(err)
+	is.True(stat.IsDir())
+
+	// Stale files within synced directories don't remove the directory
+	delete(fallback, "a/x.txt")
+	fsys.GenerateDir("a", func(fsys genfs.FS, dir *genfs.Dir) error {
+		return nil
+	})
+	is.NoErr(genfs.Sync(fsys, dir))
+	stat, err = os.Stat(filepath.Join(dir, "a"))
+	is.NoErr(err)
+	is.True(stat.IsDir())
+	_, err = os.Stat(filepath.Join(dir, "a/x.txt"))
+	is.True(errors.Is(err, fs.ErrNotExist))
+}
+
+func TestStat(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{
+		"src/a.txt": "a",
+	})
+	fsys.Cache = cache.Memory()
+	called := map[string]int{}
+	fsys.GenerateDir("dist", func(fsys genfs.FS, dir *genfs.Dir) error {
+		called[dir.Path()]++
+		_, err := dir.GenerateDir("css", func(fsys genfs.FS, dir *genfs.Dir) error {
+			called[dir.Path()]++
+			return nil
+		})
+		return err
+	})
+	fsys.GenerateFile("public/index.html", func(fsys genfs.FS, file *genfs.File) error {
+		called[file.Target()]++
+		file.WriteString("<h1>index</h1>")
+		return nil
+	})
+
+	// Filler directories don't run generators
+	stat, err := fsys.Stat("public")
+	is.NoErr(err)
+	is.Equal(stat.Name(), "public")
+	is.True(stat.IsDir())
+	is.Equal(len(called), 0)
+
+	// Files are generated once, then described from the cache
+	stat, err = fsys.Stat("public/index.html")
+	is.NoErr(err)
+	is.Equal(stat.Name(), "index.html")
+	is.Equal(stat.Size(), int64(14))
+	is.Equal(called["public/index.html"], 1)
+	stat, err = fs.Stat(fsys, "public/index.html")
+	is.NoErr(err)
+	is.Equal(stat.Size(), int64(14))
+	is.Equal(called["public/index.html"], 1)
+
+	// Describing directory entries doesn't run their generators
+	des, err := fs.ReadDir(fsys, "dist")
+	is.NoErr(err)
+	is.Equal(len(des), 1)
+	is.Equal(called["dist"], 1)
+	info, err := des[0].Info()
+	is.NoErr(err)
+	is.Equal(info.Name(), "css")
+	is.True(info.IsDir())
+	is.Equal(called["dist/css"], 0)
+
+	// Walking generated files and describing them doesn't run their generators
+	for _, name := range []string{"a.txt", "b.txt"} {
+		fsys.GenerateFile("walk/"+name, func(fsys genfs.FS, file *genfs.File) error {
+			called[file.Target()]++
+			file.WriteString("walk")
+			return nil
+		})
+	}
+	var infos []fs.FileInfo
+	err = fs.WalkDir(fsys, "walk", func(path string, de fs.DirEntry, err error) error {
+		if err != nil || de.IsDir() {
+			return err
+		}
+		info, err := de.Info()
+		if err != nil {
+			return err
+		}
+		is.Equal(info.Name(), de.Name())
+		is.Equal(info.Mode(), fs.FileMode(0))
+		is.True(!info.IsDir())
+		infos = append(infos, info)
+		return nil
+	})
+	is.NoErr(err)
+	is.Equal(len(infos), 2)
+	is.Equal(called["walk/a.txt"], 0)
+	is.Equal(called["walk/b.txt"], 0)
+
+	// The size isn't known until the file is generated
+	is.Equal(infos[0].Size(), int64(4))
+	is.Equal(infos[0].Size(), int64(4))
+	is.Equal(called["walk/a.txt"], 1)
+	is.Equal(called["walk/b.txt"], 0)
+
+	// Generated files are described from the cache
+	des, err = fs.ReadDir(fsys, "walk")
+	is.NoErr(err)
+	info, err = des[0].Info()
+	is.NoErr(err)
+	is.Equal(info.Name(), "a.txt")
+	is.Equal(info.Size(), int64(4))
+	is.Equal(called["walk/a.txt"], 1)
+
+	// Fallback files
+	stat, err = fsys.Stat("src/a.txt")
+	is.NoErr(err)
+	is.Equal(stat.Name(), "a.txt")
+	is.Equal(stat.Size(), int64(1))
+
+	_, err = fsys.Stat("public/about.html")
+	is.True(errors.Is(err, fs.ErrNotExist))
+	_, err = fsys.Stat("public/")
+	is.True(errors.Is(err, fs.ErrInvalid))
+}
+
+func TestReadFile(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{
+		"src/a.txt": "a",
+	})
+	fsys.Cache = cache.Memory()
+	called := 0
+	fsys.GenerateFile("dist/a.txt", func(fsys genfs.FS, file *genfs.File) error {
+		called++
+		code, err := fs.ReadFile(fsys, "src/a.txt")
+		if err != nil {
+			return err
+		}
+		file.Write(code)
+		file.WriteString("b")
+		return nil
+	})
+	fsys.GenerateFile("dist/empty.txt", func(fsys genfs.FS, file *genfs.File) error {
+		return nil
+	})
+	code, err := fsys.ReadFile("dist/a.txt")
+	is.NoErr(err)
+	is.Equal(string(code), "ab")
+	is.Equal(called, 1)
+
+	// Modifying the result doesn't modify the cache
+	code[0] = 'z'
+	code, err = fsys.ReadFile("dist/a.txt")
+	is.NoErr(err)
+	is.Equal(string(code), "ab")
+	is.Equal(called, 1)
+
+	code, err = fsys.ReadFile("dist/empty.txt")
+	is.NoErr(err)
+	is.True(code != nil)
+	is.Equal(len(code), 0)
+
+	code, err = fsys.ReadFile("src/a.txt")
+	is.NoErr(err)
+	is.Equal(string(code), "a")
+
+	_, err = fsys.ReadFile("dist")
+	is.True(errors.Is(err, fs.ErrInvalid))
+	_, err = fsys.ReadFile("dist/b.txt")
+	is.True(errors.Is(err, fs.ErrNotExist))
+	_, err = fsys.ReadFile("/dist/a.txt")
+	is.True(errors.Is(err, fs.ErrInvalid))
+}
+
+func TestGlob(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{
+		"dist/static/index.html": "static",
+		"src/index.html":         "src",
+	})
+	called := map[string]int{}
+	fsys.GenerateDir("dist", func(fsys genfs.FS, dir *genfs.Dir) error {
+		called[dir.Path()]++
+		for _, page := range []string{"about", "blog"} {
+			_, err := dir.GenerateDir(page, func(fsys genfs.FS, dir *genfs.Dir) error {
+				called[dir.Path()]++
+				return dir.GenerateFile("index.html", func(fsys genfs.FS, file *genfs.File) error {
+					called[file.Target()]++
+					return nil
+				})
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	fsys.GenerateDir("docs", func(fsys genfs.FS, dir *genfs.Dir) error {
+		called[dir.Path()]++
+		return nil
+	})
+	matches, err := fsys.Glob("dist/*/index.html")
+	is.NoErr(err)
+	is.Equal(matches, []string{"dist/about/index.html", "dist/blog/index.html", "dist/static/index.html"})
+	is.Equal(called["dist"], 1)
+	is.Equal(called["dist/about"], 1)
+	is.Equal(called["dist/blog"], 1)
+	// Unrelated directories and files aren't generated
+	is.Equal(called["docs"], 0)
+	is.Equal(called["dist/about/index.html"], 0)
+
+	matches, err = fs.Glob(fsys, "*/index.html")
+	is.NoErr(err)
+	is.Equal(matches, []string{"src/index.html"})
+
+	matches, err = fs.Glob(fsys, "dist/b*")
+	is.NoErr(err)
+	is.Equal(matches, []string{"dist/blog"})
+
+	matches, err = fs.Glob(fsys, "dist/about/index.html")
+	is.NoErr(err)
+	is.Equal(matches, []string{"dist/about/index.html"})
+
+	_, err = fs.Glob(fsys, "dist/[")
+	is.True(errors.Is(err, path.ErrBadPattern))
+}
+
+func TestSubFileSystem(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{
+		"pages/readme.md": "readme",
+	})
+	fsys.Root = "/app"
+	fsys.Cache = cache.Memory()
+	called := map[string]int{}
+	fsys.GenerateFile("pages/index.html", func(fsys genfs.FS, file *genfs.File) error {
+		called[file.Target()]++
+		file.WriteString("<h1>index</h1>")
+		return nil
+	})
+	sub, err := fs.Sub(fsys, "pages")
+	is.NoErr(err)
+	pages, ok := sub.(*genfs.FileSystem)
+	is.True(ok)
+	is.Equal(pages.Root, "/app/pages")
+	is.NoErr(pages.GenerateFile("about.html", func(fsys genfs.FS, file *genfs.File) error {
+		called[file.Target()]++
+		is.Equal(file.Path(), "about.html")
+		// Generators registered on the view read relative to the view
+		code, err := fs.ReadFile(fsys, "index.html")
+		if err != nil {
+			return err
+		}
+		file.Write(code)
+		return nil
+	}))
+	_, err = pages.GenerateDir("blog", func(fsys genfs.FS, dir *genfs.Dir) error {
+		is.Equal(dir.Path(), "blog")
+		is.Equal(dir.Target(), "/app/pages/blog/post.html")
+		return dir.GenerateFile("post.html", func(fsys genfs.FS, file *genfs.File) error {
+			called[file.Target()]++
+			file.WriteString("<h1>post</h1>")
+			return nil
+		})
+	})
+	is.NoErr(err)
+
+	code, err := fs.ReadFile(pages, "about.html")
+	is.NoErr(err)
+	is.Equal(string(code), "<h1>index</h1>")
+	is.Equal(called["/app/pages/about.html"], 1)
+	is.Equal(called["/app/pages/index.html"], 1)
+
+	// The cache is shared with the parent
+	code, err = fs.ReadFile(fsys, "pages/about.html")
+	is.NoErr(err)
+	is.Equal(string(code), "<h1>index</h1>")
+	code, err = fs.ReadFile(fsys, "pages/index.html")
+	is.NoErr(err)
+	is.Equal(string(code), "<h1>index</h1>")
+	is.Equal(called["/app/pages/about.html"], 1)
+	is.Equal(called["/app/pages/index.html"], 1)
+
+	// Dependencies are linked by their full path
+	is.NoErr(fsys.Invalidate("pages/index.html"))
+	code, err = fs.ReadFile(pages, "about.html")
+	is.NoErr(err)
+	is.Equal(string(code), "<h1>index</h1>")
+	is.Equal(called["/app/pages/about.html"], 2)
+	is.Equal(called["/app/pages/index.html"], 2)
+
+	code, err = fs.ReadFile(pages, "blog/post.html")
+	is.NoErr(err)
+	is.Equal(string(code), "<h1>post</h1>")
+	is.Equal(called["/app/pages/blog/post.html"], 1)
+
+	code, err = fs.ReadFile(pages, "readme.md")
+	is.NoErr(err)
+	is.Equal(string(code), "readme")
+
+	matches, err := fs.Glob(pages, "*.*")
+	is.NoErr(err)
+	is.Equal(matches, []string{"about.html", "index.html", "readme.md"})
+
+	// Nested views
+	blog, err := fs.Sub(pages, "blog")
+	is.NoErr(err)
+	code, err = fs.ReadFile(blog, "post.html")
+	is.NoErr(err)
+	is.Equal(string(code), "<h1>post</h1>")
+
+	_, err = fs.Sub(fsys, "../pages")
+	is.True(errors.Is(err, fs.ErrInvalid))
+
+	is.NoErr(fstest.TestFS(pages, "index.html", "about.html", "blog/post.html", "readme.md"))
+}
+
+func TestSubSettings(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{})
+	fsys.Cache = cache.Memory()
+	fsys.Limits.MaxSize = 4
+	called := 0
+	generate := func(fsys genfs.FS, file *genfs.File) error {
+		called++
+		_, err := file.WriteString("hello")
+		return err
+	}
+	is.NoErr(fsys.GenerateFile("a/b.txt", generate))
+	sub, err := fsys.Sub("a")
+	is.NoErr(err)
+	view := sub.(*genfs.FileSystem)
+
+	// Settings are copied when the view is created
+	is.Equal(view.Cache, fsys.Cache)
+	is.Equal(view.Limits, fsys.Limits)
+
+	// Generators run with the settings of the filesystem they were registered
+	// through
+	view.Limits.MaxSize = 0
+	is.Equal(fsys.Limits.MaxSize, int64(4))
+	is.NoErr(view.GenerateFile("c.txt", generate))
+	code, err := fs.ReadFile(view, "c.txt")
+	is.NoErr(err)
+	is.Equal(string(code), "hello")
+	_, err = fs.ReadFile(view, "b.txt")
+	is.True(errors.Is(err, genfs.ErrLimit))
+	is.Equal(called, 2)
+
+	// Reads use the cache of the filesystem they're made through
+	fsys.Cache = cache.Memory()
+	_, err = fs.ReadFile(view, "c.txt")
+	is.NoErr(err)
+	is.Equal(called, 2)
+	_, err = fs.ReadFile(fsys, "a/c.txt")
+	is.NoErr(err)
+	is.Equal(called, 3)
+}
+
+func TestPatternFile(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{})
+	called := 0
+	is.NoErr(fsys.GenerateFile("posts/{slug}.html", func(fsys genfs.FS, file *genfs.File) error {
+		called++
+		is.Equal(file.Path(), "posts/"+file.Param("slug")+".html")
+		file.WriteString("<h1>" + file.Param("slug") + "</h1>")
+		return nil
+	}))
+	is.NoErr(fsys.GenerateFile("posts/index.html", func(fsys genfs.FS, file *genfs.File) error {
+		is.Equal(file.Param("slug"), "")
+		file.WriteString("<h1>posts</h1>")
+		return nil
+	}))
+	is.NoErr(fsys.GenerateFile("assets/{path...}", func(fsys genfs.FS, file *genfs.File) error {
+		file.WriteString(file.Param("path"))
+		return nil
+	}))
+	code, err := fs.ReadFile(fsys, "posts/hello-world.html")
+	is.NoErr(err)
+	is.Equal(string(code), "<h1>hello-world</h1>")
+	code, err = fs.ReadFile(fsys, "posts/index.html")
+	is.NoErr(err)
+	is.Equal(string(code), "<h1>posts</h1>")
+	is.Equal(called, 1)
+	code, err = fs.ReadFile(fsys, "assets/css/tailwind.css")
+	is.NoErr(err)
+	is.Equal(string(code), "css/tailwind.css")
+
+	_, err = fs.ReadFile(fsys, "posts/hello-world.txt")
+	is.True(errors.Is(err, fs.ErrNotExist))
+	_, err = fs.ReadFile(fsys, "posts/.html")
+	is.True(errors.Is(err, fs.ErrNotExist))
+	_, err = fs.ReadFile(fsys, "posts/a/b.html")
+	is.True(errors.Is(err, fs.ErrNotExist))
+	is.Equal(called, 1)
+
+	// Patterns can't be listed, so only literal files appear
+	des, err := fs.ReadDir(fsys, "posts")
+	is.NoErr(err)
+	is.Equal(len(des), 1)
+	is.Equal(des[0].Name(), "index.html")
+}
+
+func TestPatternDir(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{})
+	_, err := fsys.GenerateDir("users/{id}", func(fsys genfs.FS, dir *genfs.Dir) error {
+		is.Equal(dir.Path(), "users/"+dir.Param("id"))
+		id := dir.Param("id")
+		return dir.GenerateFile("profile.txt", func(fsys genfs.FS, file *genfs.File) error {
+			file.WriteString(id)
+			return nil
+		})
+	})
+	is.NoErr(err)
+	packages := map[string]bool{"github.com/a/b": true}
+	_, err = fsys.GenerateDir("pkg/{name...}", func(fsys genfs.FS, dir *genfs.Dir) error {
+		name := dir.Param("name")
+		if !packages[name] {
+			return fs.ErrNotExist
+		}
+		is.Equal(dir.Path(), "pkg/"+name)
+		return dir.GenerateFile("doc.go", func(fsys genfs.FS, file *genfs.File) error {
+			file.WriteString("package " + path.Base(name))
+			return nil
+		})
+	})
+	is.NoErr(err)
+	code, err := fs.ReadFile(fsys, "users/42/profile.txt")
+	is.NoErr(err)
+	is.Equal(string(code), "42")
+	code, err = fs.ReadFile(fsys, "users/7/profile.txt")
+	is.NoErr(err)
+	is.Equal(string(code), "7")
+	des, err := fs.ReadDir(fsys, "users")
+	is.NoErr(err)
+	is.Equal(len(des), 2)
+
+	des, err = fs.ReadDir(fsys, "pkg/github.com/a/b")
+	is.NoErr(err)
+	is.Equal(len(des), 1)
+	is.Equal(des[0].Name(), "doc.go")
+	code, err = fs.ReadFile(fsys, "pkg/github.com/a/b/doc.go")
+	is.NoErr(err)
+	is.Equal(string(code), "package b")
+	_, err = fs.ReadFile(fsys, "pkg/github.com/c/doc.go")
+	is.True(errors.Is(err, fs.ErrNotExist))
+}
+
+func TestPatternDirRest(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{})
+	called := map[string]int{}
+	// The generator accepts any name, so "pkg/a/doc.go" could be a directory
+	_, err := fsys.GenerateDir("pkg/{name...}", func(fsys genfs.FS, dir *genfs.Dir) error {
+		name := dir.Param("name")
+		called[name]++
+		return dir.GenerateFile("doc.go", func(fsys genfs.FS, file *genfs.File) error {
+			file.WriteString("package " + path.Base(name))
+			return nil
+		})
+	})
+	is.NoErr(err)
+
+	// Files generated by the directory one level up take precedence
+	stat, err := fs.Stat(fsys, "pkg/a/doc.go")
+	is.NoErr(err)
+	is.True(!stat.IsDir())
+	is.Equal(stat.Size(), int64(9))
+	code, err := fs.ReadFile(fsys, "pkg/a/doc.go")
+	is.NoErr(err)
+	is.Equal(string(code), "package a")
+	code, err = fs.ReadFile(fsys, "pkg/a/b/doc.go")
+	is.NoErr(err)
+	is.Equal(string(code), "package b")
+	is.Equal(called["a/doc.go"], 0)
+	is.Equal(called["a/b/doc.go"], 0)
+
+	// Nested directories still match
+	stat, err = fs.Stat(fsys, "pkg/a/b")
+	is.NoErr(err)
+	is.True(stat.IsDir())
+	stat, err = fs.Stat(fsys, "pkg/c/d")
+	is.NoErr(err)
+	is.True(stat.IsDir())
+	des, err := fs.ReadDir(fsys, "pkg/c/d")
+	is.NoErr(err)
+	is.Equal(len(des), 1)
+	is.Equal(des[0].Name(), "doc.go")
+}
+
+func TestPatternInvalid(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{})
+	noop := func(fsys genfs.FS, file *genfs.File) error { return nil }
+	is.True(errors.Is(fsys.GenerateFile("posts/{slug.html", noop), fs.ErrInvalid))
+	is.True(errors.Is(fsys.GenerateFile("posts/{}.html", noop), fs.ErrInvalid))
+	is.True(errors.Is(fsys.GenerateFile("posts/{a}-{b}.html", noop), fs.ErrInvalid))
+	is.True(errors.Is(fsys.GenerateFile("posts/{rest...}.html", noop), fs.ErrInvalid))
+	is.True(errors.Is(fsys.GenerateFile("posts/{rest...}/index.html", noop), fs.ErrInvalid))
+}
+
+func TestTransform(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{
+		"docs/intro.md":       "# intro",
+		"docs/guide/setup.md": "# setup",
+		"docs/about.md":       "# about",
+		"docs/about.html":     "<h1>custom</h1>",
+		"docs/notes.txt":      "notes",
+	})
+	fsys.Cache = cache.Memory()
+	called := 0
+	err := fsys.Transform(".md", ".html", func(fsys genfs.FS, file *genfs.File, source []byte) error {
+		called++
+		is.Equal(file.Source(), strings.TrimSuffix(file.Path(), ".html")+".md")
+		file.WriteString("<h1>" + strings.TrimPrefix(string(source), "# ") + "</h1>")
+		return nil
+	})
+	is.NoErr(err)
+
+	code, err := fs.ReadFile(fsys, "docs/intro.html")
+	is.NoErr(err)
+	is.Equal(string(code), "<h1>intro</h1>")
+	is.Equal(called, 1)
+
+	// Fallback files take precedence
+	code, err = fs.ReadFile(fsys, "docs/about.html")
+	is.NoErr(err)
+	is.Equal(string(code), "<h1>custom</h1>")
+	is.Equal(called, 1)
+
+	// Missing sources don't exist
+	_, err = fs.ReadFile(fsys, "docs/missing.html")
+	is.True(errors.Is(err, fs.ErrNotExist))
+	_, err = fs.ReadFile(fsys, "docs/notes.html")
+	is.True(errors.Is(err, fs.ErrNotExist))
+
+	// Transformed files show up when walking
+	var files []string
+	err = fs.WalkDir(fsys, ".", func(path string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !de.IsDir() {
+			files = append(files, path)
+		}
+		return nil
+	})
+	is.NoErr(err)
+	is.Equal(strings.Join(files, " "), "docs/about.html docs/about.md docs/guide/setup.html docs/guide/setup.md docs/intro.html docs/intro.md docs/notes.txt")
+
+	// Invalidating the source invalidates the transformed file
+	is.NoErr(fsys.Invalidate("docs/intro.md"))
+	_, err = fs.ReadFile(fsys, "docs/intro.html")
+	is.NoErr(err)
+	is.Equal(called, 2)
+
+	// Invalid extensions
+	err = fsys.Transform("md", ".html", nil)
+	is.True(errors.Is(err, fs.ErrInvalid))
+	err = fsys.Transform(".md", ".md", nil)
+	is.True(errors.Is(err, fs.ErrInvalid))
+}
+
+func TestTransformShared(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Tree{
+		"docs/intro.md": &virt.File{Data: []byte("# intro"), Mode: 0644},
+	})
+	var called atomic.Int32
+	release := make(chan struct{})
+	fsys.Transform(".md", ".html", func(fsys genfs.FS, file *genfs.File, source []byte) error {
+		called.Add(1)
+		<-release
+		file.Write(source)
+		return nil
+	})
+
+	// Transformed files have the same permissions as their source
+	des, err := fs.ReadDir(fsys, "docs")
+	is.NoErr(err)
+	is.Equal(len(des), 2)
+	is.Equal(des[0].Name(), "intro.html")
+	info, err := des[0].Info()
+	is.NoErr(err)
+	is.Equal(info.Mode(), fs.FileMode(0644))
+	is.Equal(called.Load(), int32(0))
+
+	// Concurrent reads share a single run of the transform
+	waiting := make(chan struct{}, 8)
+	ctx := waitingContext{context.Background(), waiting}
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			file, err := fsys.OpenContext(ctx, "docs/intro.html")
+			is.NoErr(err)
+			defer file.Close()
+			stat, err := file.Stat()
+			is.NoErr(err)
+			is.Equal(stat.Mode(), fs.FileMode(0644))
+			code, err := io.ReadAll(file)
+			is.NoErr(err)
+			is.Equal(string(code), "# intro")
+		}()
+	}
+	for i := 0; i < 7; i++ {
+		<-waiting
+	}
+	close(release)
+	wg.Wait()
+	is.Equal(called.Load(), int32(1))
+
+	// Transformed files can be globbed
+	matches, err := fs.Glob(fsys, "docs/*.html")
+	is.NoErr(err)
+	is.Equal(matches, []string{"docs/intro.html"})
+	matches, err = fs.Glob(fsys, "*/intro.*")
+	is.NoErr(err)
+	is.Equal(matches, []string{"docs/intro.html", "docs/intro.md"})
+	sub, err := fs.Sub(fsys, "docs")
+	is.NoErr(err)
+	matches, err = fs.Glob(sub, "*.html")
+	is.NoErr(err)
+	is.Equal(matches, []string{"intro.html"})
+}
+
+func TestRemove(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{
+		"a.txt": "a",
+	})
+	fsys.Cache = cache.Memory()
+	fsys.GenerateFile("b.txt", func(fsys genfs.FS, file *genfs.File) error {
+		file.WriteString("b")
+		return nil
+	})
+	fsys.GenerateFile("posts/{slug}.html", func(fsys genfs.FS, file *genfs.File) error {
+		file.WriteString(file.Param("slug"))
+		return nil
+	})
+	fsys.GenerateDir("plugin", func(fsys genfs.FS, dir *genfs.Dir) error {
+		dir.GenerateFile("index.js", func(fsys genfs.FS, file *genfs.File) error {
+			file.WriteString("plugin")
+			return nil
+		})
+		return nil
+	})
+	fsys.GenerateFile("deep/nested/c.txt", func(fsys genfs.FS, file *genfs.File) error {
+		file.WriteString("c")
+		return nil
+	})
+	for _, name := range []string{"b.txt", "posts/hello.html", "plugin/index.js", "deep/nested/c.txt"} {
+		_, err := fs.ReadFile(fsys, name)
+		is.NoErr(err)
+	}
+
+	is.NoErr(fsys.Remove("b.txt"))
+	_, err := fs.ReadFile(fsys, "b.txt")
+	is.True(errors.Is(err, fs.ErrNotExist))
+
+	// Files generated by a pattern are evicted
+	is.NoErr(fsys.Remove("posts/{slug}.html"))
+	_, err = fs.ReadFile(fsys, "posts/hello.html")
+	is.True(errors.Is(err, fs.ErrNotExist))
+
+	// Files generated by a directory generator are evicted
+	is.NoErr(fsys.Remove("plugin"))
+	_, err = fs.ReadFile(fsys, "plugin/index.js")
+	is.True(errors.Is(err, fs.ErrNotExist))
+
+	// Empty filler directories are pruned
+	is.NoErr(fsys.Remove("deep/nested/c.txt"))
+	_, err = fs.Stat(fsys, "deep")
+	is.True(errors.Is(err, fs.ErrNotExist))
+
+	// Fallback files can't be removed
+	err = fsys.Remove("a.txt")
+	is.True(errors.Is(err, fs.ErrNotExist))
+	code, err := fs.ReadFile(fsys, "a.txt")
+	is.NoErr(err)
+	is.Equal(string(code), "a")
+
+	des, err := fs.ReadDir(fsys, ".")
+	is.NoErr(err)
+	is.Equal(len(des), 1)
+	is.Equal(des[0].Name(), "a.txt")
+}
+
+func TestDirRemove(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{})
+	fsys.GenerateDir("plugins", func(fsys genfs.FS, dir *genfs.Dir) error {
+		dir.GenerateFile("a.js", func(fsys genfs.FS, file *genfs.File) error {
+			file.WriteString("a")
+			return nil
+		})
+		dir.GenerateFile("b.js", func(fsys genfs.FS, file *genfs.File) error {
+			file.WriteString("b")
+			return nil
+		})
+		return dir.Remove("a.js")
+	})
+	des, err := fs.ReadDir(fsys, "plugins")
+	is.NoErr(err)
+	is.Equal(len(des), 1)
+	is.Equal(des[0].Name(), "b.js")
+	err = fsys.Remove("plugins/c.js")
+	is.True(errors.Is(err, fs.ErrNotExist))
+}
+
+func TestRegistration(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{})
+	fsys.Cache = cache.Memory()
+	called := map[string]int{}
+	plugin := func(name string) func(fsys genfs.FS, dir *genfs.Dir) error {
+		return func(fsys genfs.FS, dir *genfs.Dir) error {
+			called[name]++
+			return dir.GenerateFile(name+".js", func(fsys genfs.FS, file *genfs.File) error {
+				file.WriteString(name)
+				return nil
+			})
+		}
+	}
+	a, err := fsys.GenerateDir("plugins", plugin("a"))
+	is.NoErr(err)
+	is.Equal(a.Path(), "plugins")
+	b, err := fsys.GenerateDir("plugins", plugin("b"))
+	is.NoErr(err)
+
+	// Both generators run, even though they share a directory
+	des, err := fs.ReadDir(fsys, "plugins")
+	is.NoErr(err)
+	is.Equal(len(des), 2)
+	is.Equal(des[0].Name(), "a.js")
+	is.Equal(des[1].Name(), "b.js")
+	is.Equal(called["a"], 1)
+	is.Equal(called["b"], 1)
+
+	// Removing one generator leaves the other in place
+	is.NoErr(a.Remove())
+	des, err = fs.ReadDir(fsys, "plugins")
+	is.NoErr(err)
+	is.Equal(len(des), 1)
+	is.Equal(des[0].Name(), "b.js")
+	_, err = fs.ReadFile(fsys, "plugins/a.js")
+	is.True(errors.Is(err, fs.ErrNotExist))
+	is.Equal(called["b"], 1)
+	err = a.Remove()
+	is.True(errors.Is(err, fs.ErrNotExist))
+
+	// Replacing a generator withdraws its previous files
+	is.NoErr(b.Replace(plugin("c")))
+	des, err = fs.ReadDir(fsys, "plugins")
+	is.NoErr(err)
+	is.Equal(len(des), 1)
+	is.Equal(des[0].Name(), "c.js")
+	code, err := fs.ReadFile(fsys, "plugins/c.js")
+	is.NoErr(err)
+	is.Equal(string(code), "c")
+	is.Equal(called["c"], 1)
+
+	// Removing the last generator removes the directory
+	is.NoErr(b.Remove())
+	_, err = fs.ReadDir(fsys, "plugins")
+	is.True(errors.Is(err, fs.ErrNotExist))
+	err = b.Replace(plugin("d"))
+	is.True(errors.Is(err, fs.ErrNotExist))
+}
+
+func TestDescribe(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{})
+	fsys.GenerateFile("a/b.txt", func(fsys genfs.FS, file *genfs.File) error {
+		return nil
+	})
+	fsys.GenerateDir("a/c", func(fsys genfs.FS, dir *genfs.Dir) error {
+		return nil
+	})
+	fsys.GenerateDir("a/c", func(fsys genfs.FS, dir *genfs.Dir) error {
+		return nil
+	})
+	fsys.GenerateFile("posts/{slug}.html", func(fsys genfs.FS, file *genfs.File) error {
+		return nil
+	})
+	nodes := fsys.Describe()
+	// Sites are covered by TestRegistrationSite
+	for _, node := range nodes {
+		is.Equal(len(node.Sites), node.Generators)
+		node.Sites = nil
+	}
+	is.Equal(len(nodes), 6)
+	is.Equal(*nodes[0], genfs.Node{Path: ".", Mode: "d-", Generators: 0})
+	is.Equal(*nodes[1], genfs.Node{Path: "a", Mode: "d-", Generators: 0})
+	is.Equal(*nodes[2], genfs.Node{Path: "a/b.txt", Mode: "-g", Generators: 1})
+	is.Equal(*nodes[3], genfs.Node{Path: "a/c", Mode: "dg", Generators: 2})
+	is.Equal(*nodes[4], genfs.Node{Path: "posts", Mode: "d-", Generators: 0})
+	is.Equal(*nodes[5], genfs.Node{Path: "posts/{slug}.html", Mode: "-g", Generators: 1})
+
+	out := fsys.Print()
+	is.True(strings.HasPrefix(out, ". mode=d-\n"))
+	is.True(strings.Contains(out, "── c mode=dg generators="))
+	is.True(strings.Contains(out, "── {slug}.html mode=-g generators="))
+
+	// Sub filesystems describe their subtree
+	sub, err := fs.Sub(fsys, "a")
+	is.NoErr(err)
+	nodes = sub.(*genfs.FileSystem).Describe()
+	is.Equal(len(nodes), 3)
+	is.Equal(nodes[0].Path, ".")
+	is.Equal(nodes[1].Path, "b.txt")
+	is.Equal(nodes[2].Path, "c")
+	out = sub.(*genfs.FileSystem).Print()
+	is.True(strings.HasPrefix(out, ". mode=d-\n├── b.txt mode=-g"))
+
+	// Unregistered sub filesystems are empty
+	sub, err = fs.Sub(fsys, "missing")
+	is.NoErr(err)
+	is.Equal(len(sub.(*genfs.FileSystem).Describe()), 0)
+	is.Equal(sub.(*genfs.FileSystem).Print(), "")
+}
+
+func TestRegistrationSite(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{})
+	_, file, line, _ := runtime.Caller(0)
+	fsys.GenerateFile("a.txt", func(fsys genfs.FS, file *genfs.File) error {
+		return errors.New("oops")
+	})
+	fsys.GenerateDir("b", func(fsys genfs.FS, dir *genfs.Dir) error {
+		return dir.GenerateFile("c.txt", func(fsys genfs.FS, file *genfs.File) error {
+			return errors.New("oops")
+		})
+	})
+	fileSite := fmt.Sprintf("%s:%d", path.Base(file), line+1)
+	dirSite := fmt.Sprintf("%s:%d", path.Base(file), line+4)
+	nestedSite := fmt.Sprintf("%s:%d", path.Base(file), line+5)
+
+	// Errors include where the failing generator was registered
+	_, err := fs.ReadFile(fsys, "a.txt")
+	is.True(err != nil)
+	is.True(strings.HasPrefix(err.Error(), `genfs: error generating "a.txt" (registered at `))
+	is.True(strings.Contains(err.Error(), fileSite+"): oops"))
+	_, err = fs.ReadFile(fsys, "b/c.txt")
+	is.True(err != nil)
+	is.True(strings.Contains(err.Error(), nestedSite+"): oops"))
+
+	// Sites are included when describing and printing the filesystem
+	nodes := fsys.Describe()
+	is.Equal(len(nodes), 4)
+	is.Equal(len(nodes[1].Sites), 1)
+	is.True(strings.HasSuffix(nodes[1].Sites[0], "/"+fileSite))
+	is.Equal(len(nodes[2].Sites), 1)
+	is.True(strings.HasSuffix(nodes[2].Sites[0], "/"+dirSite))
+	is.Equal(len(nodes[3].Sites), 1)
+	is.True(strings.HasSuffix(nodes[3].Sites[0], "/"+nestedSite))
+	out := fsys.Print()
+	is.True(strings.Contains(out, "a.txt mode=-g generators="))
+	is.True(strings.Contains(out, fileSite+"\n"))
+	is.True(strings.Contains(out, dirSite+"\n"))
+}
+
+func TestGenerateError(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{})
+	oops := errors.New("oops")
+	fsys.GenerateDir("dist", func(fsys genfs.FS, dir *genfs.Dir) error {
+		_, err := dir.GenerateDir("posts", func(fsys genfs.FS, dir *genfs.Dir) error {
+			return dir.GenerateFile("{slug}.html", func(fsys genfs.FS, file *genfs.File) error {
+				return oops
+			})
+		})
+		return err
+	})
+	fsys.GenerateFile("index.html", func(fsys genfs.FS, file *genfs.File) error {
+		_, err := fs.ReadFile(fsys, "dist/posts/hello.html")
+		return err
+	})
+	fsys.GenerateDir("broken", func(fsys genfs.FS, dir *genfs.Dir) error {
+		return oops
+	})
+
+	_, err := fs.ReadFile(fsys, "dist/posts/hello.html")
+	is.True(errors.Is(err, oops))
+	var generateErr *genfs.GenerateError
+	is.True(errors.As(err, &generateErr))
+	is.Equal(generateErr.Target, "dist/posts/hello.html")
+	is.Equal(generateErr.Path, "dist/posts/{slug}.html")
+	is.Equal(generateErr.Err, oops)
+	is.Equal(len(generateErr.Chain), 3)
+	is.Equal(generateErr.Chain[0].Path, "dist")
+	is.Equal(generateErr.Chain[1].Path, "dist/posts")
+	is.Equal(generateErr.Chain[2].Path, "dist/posts/{slug}.html")
+	is.True(strings.Contains(generateErr.Chain[2].Site, "genfs_test.go:"))
+
+	// Errors from reading other generated files are wrapped
+	_, err = fs.ReadFile(fsys, "index.html")
+	is.True(errors.Is(err, oops))
+	is.True(errors.As(err, &generateErr))
+	is.Equal(generateErr.Target, "index.html")
+	is.Equal(generateErr.Path, "index.html")
+	is.Equal(len(generateErr.Chain), 1)
+	var inner *genfs.GenerateError
+	is.True(errors.As(generateErr.Err, &inner))
+	is.Equal(inner.Target, "dist/posts/hello.html")
+
+	// Errors from reading directories keep their operation
+	_, err = fs.ReadDir(fsys, "broken")
+	is.True(errors.Is(err, oops))
+	is.True(errors.As(err, &generateErr))
+	is.Equal(generateErr.Op, "readdir")
+	is.True(strings.HasPrefix(err.Error(), `readdir: error generating "broken" (registered at `))
+	_, err = fs.ReadFile(fsys, "broken/a.txt")
+	is.True(errors.As(err, &generateErr))
+	is.Equal(generateErr.Op, "")
+	is.True(strings.HasPrefix(err.Error(), `genfs: error generating "broken/a.txt" (registered at `))
+
+	// Missing files aren't generate errors
+	_, err = fs.ReadFile(fsys, "missing.html")
+	is.True(errors.Is(err, fs.ErrNotExist))
+	is.True(!errors.As(err, &generateErr))
+
+	// Transforms that fail are generate errors too
+	fsys = genfs.New(virt.Map{"docs/intro.md": "# intro"})
+	is.NoErr(fsys.Transform(".md", ".html", func(fsys genfs.FS, file *genfs.File, source []byte) error {
+		return oops
+	}))
+	_, err = fs.ReadFile(fsys, "docs/intro.html")
+	is.True(errors.Is(err, oops))
+	is.True(errors.As(err, &generateErr))
+	is.Equal(generateErr.Target, "docs/intro.html")
+	is.Equal(generateErr.Path, "*.html")
+	is.Equal(len(generateErr.Chain), 1)
+	is.Equal(generateErr.Chain[0].Path, "*.html")
+	is.True(strings.Contains(generateErr.Chain[0].Site, "genfs_test.go:"))
+	is.True(strings.HasPrefix(err.Error(), `genfs: error generating "docs/intro.html" (registered at `))
+}
+
+func TestGeneratorPanic(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{})
+	oops := errors.New("oops")
+	fsys.GenerateFile("a.txt", func(fsys genfs.FS, file *genfs.File) error {
+		panic("boom")
+	})
+	fsys.GenerateDir("b", func(fsys genfs.FS, dir *genfs.Dir) error {
+		panic(oops)
+	})
+	fsys.GenerateFile("c.txt", func(fsys genfs.FS, file *genfs.File) error {
+		file.WriteString("c")
+		return nil
+	})
+
+	_, err := fs.ReadFile(fsys, "a.txt")
+	is.True(err != nil)
+	var panicErr *genfs.PanicError
+	is.True(errors.As(err, &panicErr))
+	is.Equal(panicErr.Target, "a.txt")
+	is.Equal(panicErr.Value, "boom")
+	is.True(strings.Contains(string(panicErr.Stack), "genfs_test.go"))
+	var generateErr *genfs.GenerateError
+	is.True(errors.As(err, &generateErr))
+	is.Equal(generateErr.Path, "a.txt")
+	is.True(strings.HasSuffix(err.Error(), `generator panicked while generating "a.txt": boom`))
+	is.True(!strings.Contains(err.Error(), "goroutine"))
+
+	// Panicking with an error can be unwrapped
+	_, err = fs.ReadDir(fsys, "b")
+	is.True(errors.Is(err, oops))
+	is.True(errors.As(err, &panicErr))
+	is.Equal(panicErr.Target, "b")
+
+	// The filesystem still works
+	code, err := fs.ReadFile(fsys, "c.txt")
+	is.NoErr(err)
+	is.Equal(string(code), "c")
+
+	// Opt into crashing
+	fsys.CrashOnPanic = true
+	defer func() {
+		is.Equal(recover(), "boom")
+	}()
+	fs.ReadFile(fsys, "a.txt")
+	t.Fatal("expected a panic")
+}
+
+func TestCycle(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{
+		"src/a.md": "# a",
+	})
+	fsys.GenerateFile("a.txt", func(fsys genfs.FS, file *genfs.File) error {
+		_, err := fs.ReadFile(fsys, "b.txt")
+		return err
+	})
+	fsys.GenerateFile("b.txt", func(fsys genfs.FS, file *genfs.File) error {
+		_, err := fs.ReadFile(fsys, "a.txt")
+		return err
+	})
+	fsys.GenerateFile("c.txt", func(fsys genfs.FS, file *genfs.File) error {
+		_, err := fs.Stat(fsys, "c.txt")
+		return err
+	})
+
+	_, err := fs.ReadFile(fsys, "a.txt")
+	is.True(errors.Is(err, genfs.ErrCycle))
+	is.True(strings.HasSuffix(err.Error(), ": genfs: cycle a.txt -> b.txt -> a.txt"))
+	_, err = fs.ReadFile(fsys, "b.txt")
+	is.True(errors.Is(err, genfs.ErrCycle))
+	is.True(strings.HasSuffix(err.Error(), ": genfs: cycle b.txt -> a.txt -> b.txt"))
+	_, err = fs.ReadFile(fsys, "c.txt")
+	is.True(errors.Is(err, genfs.ErrCycle))
+	is.True(strings.HasSuffix(err.Error(), ": genfs: cycle c.txt -> c.txt"))
+
+	// Directory generators can list their own directory and check for missing
+	// files within it
+	fsys.GenerateDir("dist", func(fsys genfs.FS, dir *genfs.Dir) error {
+		des, err := fs.ReadDir(fsys, "dist")
+		if err != nil {
+			return err
+		}
+		is.Equal(len(des), 0)
+		if _, err := fs.Stat(fsys, "dist/missing.txt"); !errors.Is(err, fs.ErrNotExist) {
+			return fmt.Errorf("expected dist/missing.txt not to exist: %w", err)
+		}
+		return dir.GenerateFile("index.txt", func(fsys genfs.FS, file *genfs.File) error {
+			_, err := fs.ReadFile(fsys, "dist/index.txt")
+			return err
+		})
+	})
+	des, err := fs.ReadDir(fsys, "dist")
+	is.NoErr(err)
+	is.Equal(len(des), 1)
+	_, err = fs.ReadFile(fsys, "dist/index.txt")
+	is.True(errors.Is(err, genfs.ErrCycle))
+	is.True(strings.HasSuffix(err.Error(), ": genfs: cycle dist/index.txt -> dist/index.txt"))
+
+	// Other generators can't list a directory that's still being generated
+	fsys.GenerateDir("pkg", func(fsys genfs.FS, dir *genfs.Dir) error {
+		_, err := fs.ReadFile(fsys, "pkg.txt")
+		return err
+	})
+	fsys.GenerateFile("pkg.txt", func(fsys genfs.FS, file *genfs.File) error {
+		_, err := fs.ReadDir(fsys, "pkg")
+		return err
+	})
+	_, err = fs.ReadDir(fsys, "pkg")
+	is.True(errors.Is(err, genfs.ErrCycle))
+	is.True(strings.HasSuffix(err.Error(), ": genfs: cycle pkg -> pkg.txt -> pkg"))
+
+	// Transforms can't read themselves either
+	fsys.Transform(".md", ".html", func(fsys genfs.FS, file *genfs.File, source []byte) error {
+		_, err := fs.ReadFile(fsys, file.Path())
+		return err
+	})
+	_, err = fs.ReadFile(fsys, "src/a.html")
+	is.True(errors.Is(err, genfs.ErrCycle))
+}
+
+func TestCycleConcurrent(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{})
+	// Both generators are running before either reads the other
+	var started sync.WaitGroup
+	started.Add(2)
+	fsys.GenerateFile("a.txt", func(fsys genfs.FS, file *genfs.File) error {
+		started.Done()
+		started.Wait()
+		_, err := fs.ReadFile(fsys, "b.txt")
+		return err
+	})
+	fsys.GenerateFile("b.txt", func(fsys genfs.FS, file *genfs.File) error {
+		started.Done()
+		started.Wait()
+		_, err := fs.ReadFile(fsys, "a.txt")
+		return err
+	})
+	errs := make(chan error, 2)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		go func(name string) {
+			_, err := fs.ReadFile(fsys, name)
+			errs <- err
+		}(name)
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			is.True(errors.Is(err, genfs.ErrCycle))
+			is.True(strings.Contains(err.Error(), "genfs: cycle a.txt -> b.txt -> a.txt") ||
+				strings.Contains(err.Error(), "genfs: cycle b.txt -> a.txt -> b.txt"))
+		case <-time.After(5 * time.Second):
+			t.Fatal("generators waiting on each other never finished")
+		}
+	}
+}
+
+func TestLimits(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{})
+	fsys.Limits = genfs.Limits{Timeout: 10 * time.Millisecond, MaxSize: 4}
+	block := make(chan struct{})
+	t.Cleanup(func() { close(block) })
+
+	// Generators that honor their context
+	fsys.GenerateFile("slow.txt", func(fsys genfs.FS, file *genfs.File) error {
+		<-file.Context().Done()
+		return file.Context().Err()
+	})
+	_, err := fs.ReadFile(fsys, "slow.txt")
+	is.True(errors.Is(err, genfs.ErrLimit))
+	is.True(strings.Contains(err.Error(), "generator took longer than 10ms"))
+
+	// Generators that ignore their context
+	fsys.GenerateFile("stuck.txt", func(fsys genfs.FS, file *genfs.File) error {
+		<-block
+		return nil
+	})
+	_, err = fs.ReadFile(fsys, "stuck.txt")
+	is.True(errors.Is(err, genfs.ErrLimit))
+
+	// Registrations can override the limits
+	fsys.GenerateFile("patient.txt", func(fsys genfs.FS, file *genfs.File) error {
+		time.Sleep(20 * time.Millisecond)
+		file.WriteString("patient")
+		return nil
+	}, genfs.WithTimeout(time.Minute), genfs.WithMaxSize(0))
+	code, err := fs.ReadFile(fsys, "patient.txt")
+	is.NoErr(err)
+	is.Equal(string(code), "patient")
+
+	// Writing too much fails, even if the error is ignored
+	fsys.GenerateFile("big.txt", func(fsys genfs.FS, file *genfs.File) error {
+		n, err := file.WriteString("hello")
+		is.Equal(n, 0)
+		is.True(errors.Is(err, genfs.ErrLimit))
+		return nil
+	})
+	_, err = fs.ReadFile(fsys, "big.txt")
+	is.True(errors.Is(err, genfs.ErrLimit))
+	is.True(strings.Contains(err.Error(), `"big.txt" is larger than 4 bytes`))
+
+	// Registering too many children fails, even if the error is ignored
+	fsys.GenerateDir("many", func(fsys genfs.FS, dir *genfs.Dir) error {
+		for i := 0; i < 3; i++ {
+			err := dir.GenerateFile(fmt.Sprintf("%d.txt", i), func(fsys genfs.FS, file *genfs.File) error {
+				return nil
+			})
+			is.Equal(errors.Is(err, genfs.ErrLimit), i == 2)
+		}
+		return nil
+	}, genfs.WithMaxChildren(2))
+	_, err = fs.ReadDir(fsys, "many")
+	is.True(errors.Is(err, genfs.ErrLimit))
+	is.True(strings.Contains(err.Error(), "directory generator registered more than 2 paths"))
+
+	// Registrations that fail don't count towards the limit
+	fsys.GenerateDir("invalid", func(fsys genfs.FS, dir *genfs.Dir) error {
+		is.NoErr(dir.GenerateFile("a.txt", func(fsys genfs.FS, file *genfs.File) error {
+			return nil
+		}))
+		_, err := dir.GenerateDir("a.txt", func(fsys genfs.FS, dir *genfs.Dir) error {
+			return nil
+		})
+		is.True(errors.Is(err, fs.ErrInvalid))
+		return dir.GenerateFile("b.txt", func(fsys genfs.FS, file *genfs.File) error {
+			return nil
+		})
+	}, genfs.WithMaxChildren(2))
+	des, err := fs.ReadDir(fsys, "invalid")
+	is.NoErr(err)
+	is.Equal(len(des), 2)
+
+	// Generators that keep running after their timeout can't write or register
+	// paths anymore
+	proceed := make(chan struct{})
+	late := make(chan error, 2)
+	fsys.GenerateFile("late.txt", func(fsys genfs.FS, file *genfs.File) error {
+		<-proceed
+		_, err := file.WriteString("late")
+		late <- err
+		return nil
+	})
+	fsys.GenerateDir("late", func(fsys genfs.FS, dir *genfs.Dir) error {
+		<-proceed
+		late <- dir.GenerateFile("a.txt", func(fsys genfs.FS, file *genfs.File) error {
+			return nil
+		})
+		return nil
+	})
+	_, err = fs.ReadFile(fsys, "late.txt")
+	is.True(errors.Is(err, genfs.ErrLimit))
+	_, err = fs.ReadDir(fsys, "late")
+	is.True(errors.Is(err, genfs.ErrLimit))
+	close(proceed)
+	is.True(errors.Is(<-late, genfs.ErrLimit))
+	is.True(errors.Is(<-late, genfs.ErrLimit))
+
+	// Cancelling the open call isn't a limit error
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = fsys.OpenContext(ctx, "slow.txt")
+	is.True(errors.Is(err, context.Canceled))
+	is.True(!errors.Is(err, genfs.ErrLimit))
+}
+
+func TestMiddleware(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{})
+	fsys.Cache = cache.Memory()
+	var calls []string
+	fsys.GenerateFile("a.js", func(fsys genfs.FS, file *genfs.File) error {
+		file.WriteString("a")
+		return nil
+	})
+	fsys.GenerateDir("dist", func(fsys genfs.FS, dir *genfs.Dir) error {
+		return dir.GenerateFile("b.js", func(fsys genfs.FS, file *genfs.File) error {
+			return errors.New("oops")
+		})
+	})
+	fsys.Use(func(next genfs.Handler) genfs.Handler {
+		return func(fsys genfs.FS, output genfs.Output) error {
+			calls = append(calls, "outer:"+output.Path())
+			if err := next(fsys, output); err != nil {
+				return fmt.Errorf("decorated: %w", err)
+			}
+			return nil
+		}
+	}, func(next genfs.Handler) genfs.Handler {
+		return func(fsys genfs.FS, output genfs.Output) error {
+			calls = append(calls, "inner:"+output.Path())
+			if file, ok := output.(*genfs.File); ok {
+				file.WriteString("/* header */ ")
+			}
+			return next(fsys, output)
+		}
+	})
+
+	code, err := fs.ReadFile(fsys, "a.js")
+	is.NoErr(err)
+	is.Equal(string(code), "/* header */ a")
+	is.Equal(strings.Join(calls, " "), "outer:a.js inner:a.js")
+
+	// Cached files skip middleware
+	code, err = fs.ReadFile(fsys, "a.js")
+	is.NoErr(err)
+	is.Equal(string(code), "/* header */ a")
+	is.Equal(len(calls), 2)
+
+	// Directory generators and errors go through middleware too
+	calls = nil
+	_, err = fs.ReadFile(fsys, "dist/b.js")
+	is.True(err != nil)
+	is.True(strings.HasSuffix(err.Error(), ": decorated: oops"))
+	is.Equal(strings.Join(calls, " "), "outer:dist inner:dist outer:b.js inner:b.js")
+}
+
+func TestLogger(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{
+		"a.txt": "a",
+	})
+	fsys.Cache = cache.Memory()
+	out := new(strings.Builder)
+	fsys.Logger = slog.New(slog.NewTextHandler(out, &slog.HandlerOptions{
+		Level: slog.LevelDebug,
+		ReplaceAttr: func(groups []string, attr slog.Attr) slog.Attr {
+			switch attr.Key {
+			case slog.TimeKey, "duration", "generator":
+				return slog.Attr{}
+			}
+			return attr
+		},
+	}))
+	fsys.GenerateFile("b.txt", func(fsys genfs.FS, file *genfs.File) error {
+		file.WriteString("b")
+		return nil
+	})
+	fsys.GenerateFile("c.txt", func(fsys genfs.FS, file *genfs.File) error {
+		return errors.New("oops")
+	})
+
+	_, err := fs.ReadFile(fsys, "b.txt")
+	is.NoErr(err)
+	_, err = fs.ReadFile(fsys, "b.txt")
+	is.NoErr(err)
+	_, err = fs.ReadFile(fsys, "a.txt")
+	is.NoErr(err)
+	_, err = fs.ReadFile(fsys, "d.txt")
+	is.True(errors.Is(err, fs.ErrNotExist))
+	_, err = fs.ReadFile(fsys, "c.txt")
+	is.True(err != nil)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	is.Equal(len(lines), 9)
+	is.Equal(lines[0], `level=DEBUG msg="genfs: cache miss" kind=file path=b.txt`)
+	is.Equal(lines[1], `level=DEBUG msg="genfs: generator started" kind=file path=b.txt`)
+	is.Equal(lines[2], `level=DEBUG msg="genfs: generator finished" kind=file path=b.txt`)
+	is.Equal(lines[3], `level=DEBUG msg="genfs: cache hit" kind=file path=b.txt`)
+	is.Equal(lines[4], `level=DEBUG msg="genfs: found in fallback" path=a.txt`)
+	is.Equal(lines[5], `level=DEBUG msg="genfs: not found" path=d.txt reason="no generator or fallback file"`)
+	is.Equal(lines[6], `level=DEBUG msg="genfs: cache miss" kind=file path=c.txt`)
+	is.Equal(lines[7], `level=DEBUG msg="genfs: generator started" kind=file path=c.txt`)
+	is.True(strings.HasPrefix(lines[8], `level=ERROR msg="genfs: generator failed" kind=file path=c.txt error=`))
+}
+
+func TestProfile(t *testing.T) {
+	is := is.New(t)
+	fsys := genfs.New(virt.Map{})
+	fsys.Cache = cache.Memory()
+	fsys.GenerateFile("a.txt", func(fsys genfs.FS, file *genfs.File) error {
+		time.Sleep(10 * time.Millisecond)
+		file.WriteString("aaa")
+		return nil
+	})
+	fsys.GenerateFile("b.txt", func(fsys genfs.FS, file *genfs.File) error {
+		return errors.New("oops")
+	})
+	fsys.GenerateFile("c.txt", func(fsys genfs.FS, file *genfs.File) error {
+		return nil
+	})
+	fsys.GenerateDir("posts", func(fsys genfs.FS, dir *genfs.Dir) error {
+		return dir.GenerateFile("d.txt", func(fsys genfs.FS, file *genfs.File) error {
+			file.WriteString("d")
+			return nil
+		})
+	})
+
+	for i := 0; i < 3; i++ {
+		_, err := fs.ReadFile(fsys, "a.txt")
+		is.NoErr(err)
+	}
+	_, err := fs.ReadFile(fsys, "b.txt")
+	is.True(err != nil)
+	_, err = fs.ReadFile(fsys, "posts/d.txt")
+	is.NoErr(err)
+
+	profile := fsys.Profile()
+	is.Equal(len(profile.Entries), 5)
+	// Slowest first
+	a := profile.Entries[0]
+	is.Equal(a.Path, "a.txt")
+	is.Equal(a.Kind, "file")
+	is.Equal(a.Runs, 1)
+	is.Equal(a.Errors, 0)
+	is.True(a.Total >= 10*time.Millisecond)
+	is.Equal(a.Max, a.Total)
+	is.Equal(a.Bytes, int64(3))
+	is.Equal(a.Hits, 2)
+	is.Equal(a.Misses, 1)
+	is.True(a.HitRatio > 0.66 && a.HitRatio < 0.67)
+	entries := map[string]*genfs.ProfileEntry{}
+	for _, entry := range profile.Entries {
+		entries[entry.Path] = entry
+	}
+	is.Equal(entries["b.txt"].Runs, 1)
+	is.Equal(entries["b.txt"].Errors, 1)
+	is.Equal(entries["b.txt"].Bytes, int64(0))
+	// Registered but never run
+	is.Equal(entries["c.txt"].Kind, "file")
+	is.Equal(entries["c.txt"].Runs, 0)
+	is.Equal(entries["c.txt"].Total, time.Duration(0))
+	is.Equal(entries["posts"].Kind, "dir")
+	is.Equal(entries["posts"].Runs, 1)
+	is.Equal(entries["posts/d.txt"].Kind, "file")
+	is.Equal(entries["posts/d.txt"].Bytes, int64(1))
+
+	// Sub filesystems only include their own paths
+	sub, err := fsys.Sub("posts")
+	is.NoErr(err)
+	subProfile := sub.(*genfs.FileSystem).Profile()
+	is.Equal(len(subProfile.Entries), 2)
+	paths := []string{subProfile.Entries[0].Path, subProfile.Entries[1].Path}
+	sort.Strings(paths)
+	is.Equal(strings.Join(paths, " "), ". d.txt")
+
+	// Text report
+	text := new(strings.Builder)
+	is.NoErr(profile.WriteText(text))
+	lines := strings.Split(strings.TrimSpace(text.String()), "\n")
+	is.Equal(len(lines), 6)
+	is.True(strings.HasPrefix(lines[0], "PATH "))
+	is.True(strings.Contains(lines[0], "HIT RATIO"))
+	fields := strings.Fields(lines[1])
+	is.Equal(len(fields), 10)
+	is.Equal(strings.Join(fields[:4], " "), "a.txt file 1 0")
+	is.Equal(strings.Join(fields[6:], " "), "3 2 1 67%")
+
+	// JSON report
+	out := new(strings.Builder)
+	is.NoErr(profile.WriteJSON(out))
+	var report genfs.Profile
+	is.NoErr(json.Unmarshal([]byte(out.String()), &report))
+	is.Equal(len(report.Entries), 5)
+	is.Equal(*report.Entries[0], *a)
+	is.True(strings.Contains(out.String(), `"hit_ratio": `))
+
+	// Removed generators are dropped from the profile
+	is.NoErr(fsys.Remove("b.txt"))
+	is.NoErr(fsys.Remove("posts"))
+	profile = fsys.Profile()
+	is.Equal(len(profile.Entries), 2)
+	is.Equal(profile.Entries[0].Path, "a.txt")
+	is.Equal(profile.Entries[1].Path, "c.txt")
+}
@@ -0,0 +1,147 @@
+package tree
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+
+	"github.com/matthewmueller/virt"
+)
+
+var errPanicked = errors.New("tree: generator panicked")
+
+// CycleError is returned when generators wait on each other's output. The
+// paths start and end with the generator that would have waited on itself.
+type CycleError struct {
+	Paths []string
+}
+
+func (e *CycleError) Error() string {
+	return "tree: cycle " + strings.Join(e.Paths, " -> ")
+}
+
+// flight coalesces concurrent generator calls with the same key, so the
+// generator only runs once and every caller shares the result. Calls record
+// the calls they're waiting on, so generators that wait on each other fail
+// with a *CycleError instead of waiting forever, even across goroutines.
+type flight struct {
+	mu    sync.Mutex
+	calls map[string]*call
+}
+
+type call struct {
+	name  string // path being generated
+	done  chan struct{}
+	file  *virt.File
+	err   error
+	waits map[*call]int // calls that need to finish before this one can
+}
+
+type callKey struct{}
+
+// callOf returns the call being run by the generator, if any
+func callOf(ctx context.Context) (*call, bool) {
+	c, ok := ctx.Value(callKey{}).(*call)
+	return c, ok
+}
+
+func (f *flight) do(ctx context.Context, key, name string, fn func(ctx context.Context) (*virt.File, error)) (*virt.File, error) {
+	parent, _ := callOf(ctx)
+	f.mu.Lock()
+	if f.calls == nil {
+		f.calls = map[string]*call{}
+	}
+	if c, ok := f.calls[key]; ok {
+		if parent != nil {
+			// Waiting on a call that's waiting on us would never finish
+			if cycle := c.path(parent, map[*call]bool{}); cycle != nil {
+				f.mu.Unlock()
+				return nil, newCycleError(append([]*call{parent}, cycle...))
+			}
+			parent.waits[c]++
+		}
+		f.mu.Unlock()
+		file, err := f.wait(ctx, parent, c)
+		// The caller that ran the generator was cancelled, but we weren't, so
+		// try again
+		if isContextErr(err) && ctx.Err() == nil {
+			return f.do(ctx, key, name, fn)
+		}
+		return file, err
+	}
+	// Waiters see errPanicked if fn panics instead of returning
+	c := &call{name, make(chan struct{}), nil, errPanicked, map[*call]int{}}
+	f.calls[key] = c
+	if parent != nil {
+		parent.waits[c]++
+	}
+	f.mu.Unlock()
+
+	defer func() {
+		f.mu.Lock()
+		delete(f.calls, key)
+		if parent != nil {
+			parent.unwait(c)
+		}
+		f.mu.Unlock()
+		close(c.done)
+	}()
+	c.file, c.err = fn(context.WithValue(ctx, callKey{}, c))
+	return c.file, c.err
+}
+
+// wait for the call to finish
+func (f *flight) wait(ctx context.Context, parent, c *call) (*virt.File, error) {
+	if parent != nil {
+		defer func() {
+			f.mu.Lock()
+			parent.unwait(c)
+			f.mu.Unlock()
+		}()
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-c.done:
+		return c.file, c.err
+	}
+}
+
+// path returns the calls from c to target that are waiting on one another, or
+// nil if c isn't waiting on target. The flight's lock must be held.
+func (c *call) path(target *call, seen map[*call]bool) []*call {
+	if c == target {
+		return []*call{c}
+	}
+	seen[c] = true
+	for next := range c.waits {
+		if seen[next] {
+			continue
+		}
+		if path := next.path(target, seen); path != nil {
+			return append([]*call{c}, path...)
+		}
+	}
+	return nil
+}
+
+// unwait removes a call the call was waiting on. The flight's lock must be
+// held.
+func (c *call) unwait(other *call) {
+	if c.waits[other]--; c.waits[other] <= 0 {
+		delete(c.waits, other)
+	}
+}
+
+func newCycleError(calls []*call) *CycleError {
+	paths := make([]string, len(calls))
+	for i, c := range calls {
+		paths[i] = c.name
+	}
+	return &CycleError{paths}
+}
+
+func isContextErr(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
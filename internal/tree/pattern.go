@@ -0,0 +1,98 @@
+package tree
+
+import (
+	"context"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+// segment is a path segment with a named parameter, like "{slug}.html" or
+// "{path...}"
+type segment struct {
+	prefix string
+	name   string
+	suffix string
+	rest   bool // matches one or more remaining segments
+}
+
+// parseSegment parses a pattern segment. It returns nil if the segment is a
+// literal.
+func parseSegment(fpath, raw string) (*segment, error) {
+	start := strings.IndexByte(raw, '{')
+	end := strings.LastIndexByte(raw, '}')
+	if start < 0 && end < 0 {
+		return nil, nil
+	}
+	invalid := func(reason string) error {
+		return &fs.PathError{
+			Op:   "parse",
+			Path: fpath,
+			Err:  fmt.Errorf("%w: %s in %q", fs.ErrInvalid, reason, raw),
+		}
+	}
+	if start < 0 || end < start {
+		return nil, invalid("unbalanced braces")
+	}
+	seg := &segment{
+		prefix: raw[:start],
+		name:   raw[start+1 : end],
+		suffix: raw[end+1:],
+	}
+	if strings.ContainsAny(seg.prefix+seg.name+seg.suffix, "{}") {
+		return nil, invalid("only one parameter is allowed per segment")
+	}
+	if name, ok := strings.CutSuffix(seg.name, "..."); ok {
+		if seg.prefix != "" || seg.suffix != "" {
+			return nil, invalid("rest parameters must be the whole segment")
+		}
+		seg.name = name
+		seg.rest = true
+	}
+	if seg.name == "" {
+		return nil, invalid("parameter is missing a name")
+	}
+	return seg, nil
+}
+
+// match a single path segment, returning the parameter's value
+func (s *segment) match(value string) (string, bool) {
+	if len(value) <= len(s.prefix)+len(s.suffix) {
+		return "", false
+	}
+	if !strings.HasPrefix(value, s.prefix) || !strings.HasSuffix(value, s.suffix) {
+		return "", false
+	}
+	return value[len(s.prefix) : len(value)-len(s.suffix)], true
+}
+
+// sortPatterns orders pattern nodes from most to least specific
+func sortPatterns(nodes []*Node) {
+	sort.SliceStable(nodes, func(i, j int) bool {
+		a, b := nodes[i].segment, nodes[j].segment
+		if a.rest != b.rest {
+			return !a.rest
+		}
+		return len(a.prefix)+len(a.suffix) > len(b.prefix)+len(b.suffix)
+	})
+}
+
+// Route is the concrete path and parameters that a generator was matched
+// with.
+type Route struct {
+	Path   string
+	Params map[string]string
+}
+
+type routeKey struct{}
+
+func withRoute(ctx context.Context, route *Route) context.Context {
+	return context.WithValue(ctx, routeKey{}, route)
+}
+
+// RouteOf returns the route of the generator being run.
+func RouteOf(ctx context.Context) (*Route, bool) {
+	route, ok := ctx.Value(routeKey{}).(*Route)
+	return route, ok
+}
@@ -1,12 +1,14 @@
 package tree
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io/fs"
 	"path"
 	"sort"
 	"strings"
+	"sync"
 
 	"github.com/matthewmueller/genfs/cache"
 	"github.com/matthewmueller/virt"
@@ -14,7 +16,7 @@ import (
 )
 
 type Generator interface {
-	Generate(cache cache.Interface, target string) (*virt.File, error)
+	Generate(ctx context.Context, cache cache.Interface, target string) (*virt.File, error)
 }
 
 func New() *Tree {
@@ -27,11 +29,17 @@ func New() *Tree {
 	}
 }
 
+// Tree is safe for concurrent use. Generators are called without holding the
+// lock, so they may register new nodes while they run.
 type Tree struct {
-	root *Node
+	mu     sync.RWMutex
+	root   *Node
+	flight flight
 }
 
 func (t *Tree) GenerateFile(fpath string, generator Generator) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	fpath = path.Clean(fpath)
 	if fpath == "." {
 		return &fs.PathError{
@@ -47,15 +55,14 @@ func (t *Tree) GenerateFile(fpath string, generator Generator) error {
 		return err
 	}
 	name := path.Base(fpath)
-	child, ok := parent.children[name]
+	child, ok := parent.child(name)
 	if !ok {
 		// create the file generator
-		parent.children[name] = &Node{
+		return parent.add(fpath, &Node{
 			Name:       name,
 			Mode:       ModeGen,
 			Generators: []Generator{generator},
-		}
-		return nil
+		})
 	}
 	switch child.Mode {
 	case ModeGen:
@@ -72,6 +79,8 @@ func (t *Tree) GenerateFile(fpath string, generator Generator) error {
 }
 
 func (t *Tree) GenerateDir(fpath string, generator Generator) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	fpath = path.Clean(fpath)
 	// Turn the root into a dir generator
 	if fpath == "." {
@@ -86,16 +95,15 @@ func (t *Tree) GenerateDir(fpath string, generator Generator) error {
 		return err
 	}
 	name := path.Base(fpath)
-	child, ok := parent.children[name]
+	child, ok := parent.child(name)
 	if !ok {
 		// create the directory generator
-		parent.children[name] = &Node{
+		return parent.add(fpath, &Node{
 			Name:       name,
 			Mode:       ModeGen | ModeDir,
 			Generators: []Generator{generator},
 			children:   map[string]*Node{},
-		}
-		return nil
+		})
 	}
 	switch child.Mode {
 	case ModeGenDir:
@@ -115,66 +123,95 @@ func (t *Tree) GenerateDir(fpath string, generator Generator) error {
 }
 
 func (t *Tree) FindPrefix(fpath string) (*Match, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 	fpath = path.Clean(fpath)
 	if fpath == "." {
-		return &Match{
-			Path:       ".",
-			Mode:       t.root.Mode,
-			generators: t.root.Generators,
-			node:       t.root,
-		}, true
+		return t.match(".", t.root), true
 	}
 	segments := strings.Split(fpath, "/")
-	node, remaining := t.root.findPrefix(segments)
+	found := t.root.findPrefix(segments)
 	// Nodes that aren't dirs must be an exact match
-	if len(remaining) > 0 && !node.Mode.IsDir() {
+	if len(found.remaining) > 0 && !found.node.Mode.IsDir() {
 		return nil, false
 	}
-	prefix := strings.Join(segments[:len(segments)-len(remaining)], "/")
-	return &Match{
-		Path:       path.Clean(prefix),
-		Mode:       node.Mode,
-		generators: node.Generators,
-		node:       node,
-	}, true
+	prefix := strings.Join(segments[:len(segments)-len(found.remaining)], "/")
+	match := t.match(path.Clean(prefix), found.node)
+	match.Params = found.params
+	return match, true
 }
 
 func (t *Tree) Find(fpath string) (*Match, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 	fpath = path.Clean(fpath)
 	if fpath == "." {
-		return &Match{
-			Path:       ".",
-			Mode:       t.root.Mode,
-			generators: t.root.Generators,
-			node:       t.root,
-		}, true
+		return t.match(".", t.root), true
 	}
 	segments := strings.Split(fpath, "/")
-	node, ok := t.root.find(segments)
+	params := map[string]string{}
+	node, ok := t.root.find(segments, params)
 	if !ok {
 		return nil, false
 	}
+	match := t.match(fpath, node)
+	if len(params) > 0 {
+		match.Params = params
+	}
+	return match, true
+}
+
+// match snapshots the node so it can be generated without holding the lock
+func (t *Tree) match(fpath string, node *Node) *Match {
 	return &Match{
 		Path:       fpath,
 		Mode:       node.Mode,
-		generators: node.Generators,
+		generators: append([]Generator(nil), node.Generators...),
 		node:       node,
-	}, true
+		tree:       t,
+	}
 }
 
 type Match struct {
 	Path       string
 	Mode       Mode
+	Params     map[string]string // set when matched by a pattern
 	generators []Generator
 	node       *Node
+	tree       *Tree
+}
+
+// Nested returns true if the match is a directory with a rest parameter that
+// spans more than one segment, like "pkg/{name...}" matching "pkg/a/doc.go".
+// Such paths may also be generated by the directory one segment up.
+func (m *Match) Nested() bool {
+	segment := m.node.segment
+	return segment != nil && segment.rest && m.Mode.IsDir() && strings.Contains(m.Params[segment.name], "/")
 }
 
 func (m *Match) entries() (entries []*virt.DirEntry) {
-	for _, child := range m.node.children {
-		entries = append(entries, &virt.DirEntry{
-			Path: path.Join(m.Path, child.Name),
-			Mode: child.Mode.FileMode(),
-		})
+	m.tree.mu.RLock()
+	defer m.tree.mu.RUnlock()
+	nodes := []*Node{m.node}
+	// Generators matched by a pattern register their children under the
+	// concrete path, so include those too
+	if m.Params != nil {
+		if node, ok := m.tree.root.find(strings.Split(m.Path, "/"), map[string]string{}); ok && node != m.node && node.segment == nil {
+			nodes = append(nodes, node)
+		}
+	}
+	seen := map[string]bool{}
+	for _, node := range nodes {
+		for _, child := range node.children {
+			if seen[child.Name] {
+				continue
+			}
+			seen[child.Name] = true
+			entries = append(entries, &virt.DirEntry{
+				Path: path.Join(m.Path, child.Name),
+				Mode: child.Mode.FileMode(),
+			})
+		}
 	}
 	sort.Slice(entries, func(i, j int) bool {
 		return entries[i].Name() < entries[j].Name()
@@ -182,25 +219,42 @@ func (m *Match) entries() (entries []*virt.DirEntry) {
 	return entries
 }
 
-func (m *Match) Generate(cache cache.Interface, target string) (*virt.File, error) {
+// Generate the match for target. Concurrent calls for the same node and target
+// share a single run of the generators. Generators that end up waiting on
+// each other return a *CycleError.
+func (m *Match) Generate(ctx context.Context, cache cache.Interface, target string) (*virt.File, error) {
+	ctx = withRoute(ctx, &Route{m.Path, m.Params})
+	return m.tree.flight.do(ctx, m.Path+"\x00"+target, m.Path, func(ctx context.Context) (*virt.File, error) {
+		return m.generate(ctx, cache, target)
+	})
+}
+
+// Do calls fn once for concurrent calls with the same key, like Generate does
+// for generators in the tree. Name is the path being generated, which is
+// reported in a *CycleError if fn ends up waiting on itself.
+func (t *Tree) Do(ctx context.Context, key, name string, fn func(ctx context.Context) (*virt.File, error)) (*virt.File, error) {
+	return t.flight.do(ctx, "\x00"+key, name, fn)
+}
+
+func (m *Match) generate(ctx context.Context, cache cache.Interface, target string) (*virt.File, error) {
 	switch m.Mode {
 	case ModeGenDir:
-		return m.generateGenDir(cache, target)
+		return m.generateGenDir(ctx, cache, target)
 	case ModeGen:
-		return m.generateGen(cache, target)
+		return m.generateGen(ctx, cache, target)
 	case ModeDir:
-		return m.generateDir(cache, target)
+		return m.generateDir(ctx, cache, target)
 	default:
 		return nil, fmt.Errorf("%w: invalid mode %s", fs.ErrInvalid, m.Mode)
 	}
 }
 
-func (m *Match) generateGenDir(cache cache.Interface, target string) (*virt.File, error) {
+func (m *Match) generateGenDir(ctx context.Context, cache cache.Interface, target string) (*virt.File, error) {
 	// Run generators to discover new files, but ignore their entries since they
 	// shouldn't be creating entries anyway
 	found := false
 	for _, generator := range m.generators {
-		if _, err := generator.Generate(cache, target); err != nil {
+		if _, err := generator.Generate(ctx, cache, target); err != nil {
 			if !errors.Is(err, fs.ErrNotExist) {
 				return nil, err
 			}
@@ -219,43 +273,177 @@ func (m *Match) generateGenDir(cache cache.Interface, target string) (*virt.File
 	}, nil
 }
 
-func (m *Match) generateGen(cache cache.Interface, target string) (*virt.File, error) {
+func (m *Match) generateGen(ctx context.Context, cache cache.Interface, target string) (*virt.File, error) {
 	// There should only be one generator for a file
 	if len(m.generators) != 1 {
 		return nil, fmt.Errorf("%w: expected 1 generator, got %d", fs.ErrInvalid, len(m.generators))
 	}
-	return m.generators[0].Generate(cache, target)
+	return m.generators[0].Generate(ctx, cache, target)
 }
 
-func (m *Match) generateDir(_ cache.Interface, _ string) (*virt.File, error) {
+func (m *Match) generateDir(_ context.Context, _ cache.Interface, _ string) (*virt.File, error) {
 	// This is simply a filler directory created by mkdirAll, just return the
 	// children
+	return m.Dir(), nil
+}
+
+// Dir returns the directory with the entries registered so far, without
+// running any generators
+func (m *Match) Dir() *virt.File {
 	return &virt.File{
 		Path:    m.Path,
 		Mode:    m.Mode.FileMode(),
 		Entries: m.entries(),
-	}, nil
+	}
 }
 
 func (t *Tree) Print() string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
 	tp := treeprint.NewWithRoot(t.root.Format())
 	t.root.Print(tp)
 	return tp.String()
 }
 
-func (t *Tree) Delete(fpath string) {
+// PrintDir prints the tree beneath dir. The directory is printed as the root
+// of the tree. PrintDir returns false if there's no node at dir.
+func (t *Tree) PrintDir(dir string) (string, bool) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	node, ok := t.lookup(path.Clean(dir))
+	if !ok {
+		return "", false
+	}
+	root := *node
+	root.Name = "."
+	tp := treeprint.NewWithRoot(root.Format())
+	node.Print(tp)
+	return tp.String(), true
+}
+
+// Description describes a node in the tree
+type Description struct {
+	Path       string
+	Mode       Mode
+	Generators int
+	Names      []string // each generator formatted with %v
+}
+
+// Describe the node at dir and every node beneath it in depth-first order.
+// Describe returns nil if there's no node at dir.
+func (t *Tree) Describe(dir string) (descriptions []*Description) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	dir = path.Clean(dir)
+	node, ok := t.lookup(dir)
+	if !ok {
+		return nil
+	}
+	return node.describe(dir, descriptions)
+}
+
+func (n *Node) describe(fpath string, descriptions []*Description) []*Description {
+	var names []string
+	for _, generator := range n.Generators {
+		names = append(names, fmt.Sprintf("%v", generator))
+	}
+	descriptions = append(descriptions, &Description{
+		Path:       fpath,
+		Mode:       n.Mode,
+		Generators: len(n.Generators),
+		Names:      names,
+	})
+	for _, child := range n.Children() {
+		descriptions = child.describe(path.Join(fpath, child.Name), descriptions)
+	}
+	return descriptions
+}
+
+// Delete the node at fpath along with everything beneath it. Filler
+// directories left empty by the deletion are pruned. Delete returns the paths
+// of the removed nodes, or nil if there was no node at fpath.
+func (t *Tree) Delete(fpath string) (removed []string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
 	fpath = path.Clean(fpath)
 	if fpath == "." {
+		removed = t.root.paths(".")
 		// Reset the root
 		t.root = &Node{
 			Name:     ".",
 			Mode:     ModeDir,
 			children: map[string]*Node{},
 		}
-		return
+		return removed
 	}
 	segments := strings.Split(fpath, "/")
-	t.root.delete(segments)
+	child, ok := t.root.delete(segments)
+	if !ok {
+		return nil
+	}
+	return child.paths(fpath)
+}
+
+// RemoveGenerator removes a single generator from the directory at fpath,
+// leaving the directory's other generators in place. Directories left without
+// generators or children are pruned. RemoveGenerator returns false if the
+// generator isn't registered at fpath.
+func (t *Tree) RemoveGenerator(fpath string, generator Generator) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	fpath = path.Clean(fpath)
+	node, ok := t.lookup(fpath)
+	if !ok {
+		return false
+	}
+	index := -1
+	for i, g := range node.Generators {
+		if g == generator {
+			index = i
+			break
+		}
+	}
+	if index < 0 {
+		return false
+	}
+	node.Generators = append(node.Generators[:index:index], node.Generators[index+1:]...)
+	if len(node.Generators) > 0 {
+		return true
+	}
+	node.Mode &^= ModeGen
+	if node != t.root && len(node.children) == 0 && len(node.patterns) == 0 {
+		t.root.delete(strings.Split(fpath, "/"))
+	}
+	return true
+}
+
+// Generators returns the generators registered at fpath. Like Delete, patterns
+// are looked up by their name rather than matched.
+func (t *Tree) Generators(fpath string) []Generator {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	node, ok := t.lookup(path.Clean(fpath))
+	if !ok {
+		return nil
+	}
+	return append([]Generator(nil), node.Generators...)
+}
+
+// lookup the node registered at fpath. Unlike Find, patterns are looked up by
+// their name rather than matched.
+func (t *Tree) lookup(fpath string) (*Node, bool) {
+	node := t.root
+	if fpath == "." {
+		return node, true
+	}
+	for _, segment := range strings.Split(fpath, "/") {
+		child, ok := node.child(segment)
+		if !ok {
+			return nil, false
+		}
+		node = child
+	}
+	return node, true
 }
 
 type Node struct {
@@ -263,6 +451,37 @@ type Node struct {
 	Mode       Mode
 	Generators []Generator
 	children   map[string]*Node
+	patterns   []*Node  // children with parameters, most specific first
+	segment    *segment // set when the node is a pattern
+}
+
+// child finds a child by its name, which may be a pattern
+func (n *Node) child(name string) (*Node, bool) {
+	if child, ok := n.children[name]; ok {
+		return child, true
+	}
+	for _, child := range n.patterns {
+		if child.Name == name {
+			return child, true
+		}
+	}
+	return nil, false
+}
+
+// add a new child, parsing its name if it's a pattern
+func (n *Node) add(fpath string, child *Node) error {
+	segment, err := parseSegment(fpath, child.Name)
+	if err != nil {
+		return err
+	}
+	if segment == nil {
+		n.children[child.Name] = child
+		return nil
+	}
+	child.segment = segment
+	n.patterns = append(n.patterns, child)
+	sortPatterns(n.patterns)
+	return nil
 }
 
 func (t *Tree) mkdirAll(dir string) (node *Node, err error) {
@@ -270,22 +489,35 @@ func (t *Tree) mkdirAll(dir string) (node *Node, err error) {
 		return t.root, nil
 	}
 	segments := strings.Split(dir, "/")
-	return t.root.mkdirAll(segments)
+	return t.root.mkdirAll(dir, segments)
 }
 
-func (n *Node) mkdirAll(segments []string) (*Node, error) {
+func (n *Node) mkdirAll(dir string, segments []string) (*Node, error) {
 	if len(segments) == 0 {
 		return n, nil
 	}
 	next := segments[0]
-	child, ok := n.children[next]
+	child, ok := n.child(next)
 	if !ok {
-		n.children[next] = &Node{
+		segment, err := parseSegment(dir, next)
+		if err != nil {
+			return nil, err
+		} else if segment != nil && segment.rest {
+			return nil, &fs.PathError{
+				Op:   "mkdirAll",
+				Path: dir,
+				Err:  fmt.Errorf("%w: rest parameters must be last", fs.ErrInvalid),
+			}
+		}
+		child = &Node{
 			Name:     next,
 			Mode:     ModeDir,
 			children: map[string]*Node{},
 		}
-		return n.children[next].mkdirAll(segments[1:])
+		if err := n.add(dir, child); err != nil {
+			return nil, err
+		}
+		return child.mkdirAll(dir, segments[1:])
 	}
 	if !child.Mode.IsDir() {
 		return nil, &fs.PathError{
@@ -293,45 +525,139 @@ func (n *Node) mkdirAll(segments []string) (*Node, error) {
 			Path: strings.Join(segments, "/"),
 			Err:  fmt.Errorf("%w: path is already a file", fs.ErrInvalid),
 		}
+	} else if child.segment != nil && child.segment.rest {
+		return nil, &fs.PathError{
+			Op:   "mkdirAll",
+			Path: dir,
+			Err:  fmt.Errorf("%w: rest parameters must be last", fs.ErrInvalid),
+		}
 	}
-	return child.mkdirAll(segments[1:])
+	return child.mkdirAll(dir, segments[1:])
 }
 
-func (n *Node) find(segments []string) (*Node, bool) {
+// find the node matching segments exactly. Literal children take precedence
+// over patterns.
+func (n *Node) find(segments []string, params map[string]string) (*Node, bool) {
 	if len(segments) == 0 {
 		return n, true
 	}
 	next := segments[0]
-	child, ok := n.children[next]
-	if !ok {
-		return nil, false
+	if child, ok := n.children[next]; ok {
+		if node, ok := child.find(segments[1:], params); ok {
+			return node, true
+		}
+	}
+	for _, child := range n.patterns {
+		if child.segment.rest {
+			params[child.segment.name] = strings.Join(segments, "/")
+			return child, true
+		}
+		value, ok := child.segment.match(next)
+		if !ok {
+			continue
+		}
+		if node, ok := child.find(segments[1:], params); ok {
+			params[child.segment.name] = value
+			return node, true
+		}
 	}
-	return child.find(segments[1:])
+	return nil, false
 }
 
-func (n *Node) findPrefix(segments []string) (*Node, []string) {
+type found struct {
+	node      *Node
+	remaining []string
+	params    map[string]string
+}
+
+// findPrefix finds the deepest node along segments. Literal children take
+// precedence over patterns that match equally deep.
+func (n *Node) findPrefix(segments []string) found {
+	best := found{n, segments, nil}
 	if len(segments) == 0 {
-		return n, segments
+		return best
 	}
 	next := segments[0]
-	child, ok := n.children[next]
-	if !ok {
-		return n, segments
+	if child, ok := n.children[next]; ok {
+		best = child.findPrefix(segments[1:])
+	}
+	for _, child := range n.patterns {
+		var candidate found
+		if child.segment.rest {
+			// Directories match everything up to the last segment, which is what
+			// they'll generate. Files match everything.
+			if !child.Mode.IsDir() {
+				candidate = found{child, nil, map[string]string{}}
+				candidate.params[child.segment.name] = strings.Join(segments, "/")
+			} else if len(segments) > 1 {
+				remaining := segments[len(segments)-1:]
+				candidate = found{child, remaining, map[string]string{}}
+				candidate.params[child.segment.name] = strings.Join(segments[:len(segments)-1], "/")
+			} else {
+				continue
+			}
+		} else {
+			value, ok := child.segment.match(next)
+			if !ok {
+				continue
+			}
+			candidate = child.findPrefix(segments[1:])
+			params := map[string]string{child.segment.name: value}
+			for k, v := range candidate.params {
+				params[k] = v
+			}
+			candidate.params = params
+		}
+		if len(candidate.remaining) < len(best.remaining) {
+			best = candidate
+		}
 	}
-	return child.findPrefix(segments[1:])
+	return best
 }
 
-func (n *Node) delete(segments []string) {
+// delete the node at segments, returning the deleted node
+func (n *Node) delete(segments []string) (*Node, bool) {
 	next := segments[0]
-	child, ok := n.children[next]
+	child, ok := n.child(next)
 	if !ok {
-		return
+		return nil, false
 	}
 	if len(segments) == 1 {
-		delete(n.children, next)
+		n.remove(child)
+		return child, true
+	}
+	deleted, ok := child.delete(segments[1:])
+	if !ok {
+		return nil, false
+	}
+	// Prune filler directories that are now empty
+	if child.Mode == ModeDir && len(child.children) == 0 && len(child.patterns) == 0 {
+		n.remove(child)
+	}
+	return deleted, true
+}
+
+// paths returns the path of the node and every node beneath it
+func (n *Node) paths(fpath string) []string {
+	paths := []string{fpath}
+	for _, child := range n.Children() {
+		paths = append(paths, child.paths(path.Join(fpath, child.Name))...)
+	}
+	return paths
+}
+
+// remove the child from the node
+func (n *Node) remove(child *Node) {
+	if child.segment == nil {
+		delete(n.children, child.Name)
 		return
 	}
-	child.delete(segments[1:])
+	for i, pattern := range n.patterns {
+		if pattern == child {
+			n.patterns = append(n.patterns[:i:i], n.patterns[i+1:]...)
+			return
+		}
+	}
 }
 
 func (n *Node) Format() string {
@@ -355,7 +681,8 @@ func (n *Node) Children() []*Node {
 	sort.Slice(children, func(i, j int) bool {
 		return children[i].Name < children[j].Name
 	})
-	return children
+	// Patterns come after literal children in order of precedence
+	return append(children, n.patterns...)
 }
 
 func (n *Node) Print(tree treeprint.Tree) string {
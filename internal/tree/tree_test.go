@@ -1,10 +1,16 @@
 package tree_test
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"io/fs"
 	"os"
+	"path"
 	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/matryer/is"
 	"github.com/matthewmueller/genfs/cache"
@@ -29,7 +35,7 @@ func TestNew(t *testing.T) {
 
 type treeGenerator struct{ label string }
 
-func (g *treeGenerator) Generate(_ cache.Interface, target string) (*virt.File, error) {
+func (g *treeGenerator) Generate(_ context.Context, _ cache.Interface, target string) (*virt.File, error) {
 	return nil, fs.ErrNotExist
 }
 
@@ -205,7 +211,7 @@ type funcGenerator struct {
 	fn    func(_ cache.Interface, target string) (*virt.File, error)
 }
 
-func (g *funcGenerator) Generate(cache cache.Interface, target string) (*virt.File, error) {
+func (g *funcGenerator) Generate(_ context.Context, cache cache.Interface, target string) (*virt.File, error) {
 	return g.fn(cache, target)
 }
 
@@ -245,7 +251,7 @@ func TestTreeSharedDirGenerator(t *testing.T) {
 	is.True(match.Mode.IsGenDir())
 	is.Equal(tree.Print(), `. mode=dg generators=a,d
 `)
-	vfile, err := match.Generate(nil, ".")
+	vfile, err := match.Generate(context.Background(), nil, ".")
 	is.NoErr(err)
 	is.Equal(vfile.Path, ".")
 	is.True(vfile.Mode.IsDir())
@@ -304,7 +310,7 @@ func TestTreeSharedDirAndDirGenerator(t *testing.T) {
 └── favicon.ico mode=-g generators=a
 `
 	is.Equal(tree.Print(), expect)
-	vfile, err := match.Generate(nil, ".")
+	vfile, err := match.Generate(context.Background(), nil, ".")
 	is.NoErr(err)
 	is.Equal(vfile.Path, ".")
 	is.True(vfile.Mode.IsDir())
@@ -362,7 +368,7 @@ func TestTreeFileGenOverride(t *testing.T) {
 └── a.txt mode=-g generators=b
 `
 	is.Equal(tree.Print(), expect)
-	vfile, err := match.Generate(nil, "a.txt")
+	vfile, err := match.Generate(context.Background(), nil, "a.txt")
 	is.NoErr(err)
 	is.Equal(vfile.Path, "a.txt")
 	is.True(vfile.Mode.IsRegular())
@@ -387,7 +393,7 @@ func TestDynamic(t *testing.T) {
 	match, ok := tree.FindPrefix("bud/docs/a.txt")
 	is.True(ok)
 	is.Equal(match.Path, "bud")
-	vfile, err := match.Generate(nil, "bud/docs/a.txt")
+	vfile, err := match.Generate(context.Background(), nil, "bud/docs/a.txt")
 	is.NoErr(err)
 	is.Equal(vfile.Path, "bud")
 	is.True(vfile.Mode.IsDir())
@@ -399,7 +405,7 @@ func TestDynamic(t *testing.T) {
 	match, ok = tree.FindPrefix("bud/docs/a.txt")
 	is.True(ok)
 	is.Equal(match.Path, "bud/docs")
-	vfile, err = match.Generate(nil, "bud/docs/a.txt")
+	vfile, err = match.Generate(context.Background(), nil, "bud/docs/a.txt")
 	is.NoErr(err)
 	is.Equal(vfile.Path, "bud/docs")
 	is.True(vfile.Mode.IsDir())
@@ -412,7 +418,7 @@ func TestDynamic(t *testing.T) {
 	is.True(ok)
 	is.Equal(match.Path, "bud/docs/a.txt")
 	is.True(match.Mode.IsGen())
-	vfile, err = match.Generate(nil, "bud/docs/a.txt")
+	vfile, err = match.Generate(context.Background(), nil, "bud/docs/a.txt")
 	is.NoErr(err)
 	is.Equal(vfile.Path, "bud/docs/a.txt")
 	is.True(vfile.Mode.IsRegular())
@@ -425,3 +431,229 @@ func TestDynamic(t *testing.T) {
         └── a.txt mode=-g generators=c
 `)
 }
+
+func TestConcurrent(t *testing.T) {
+	is := is.New(t)
+	tree := tree.New()
+	is.NoErr(tree.GenerateDir("bud", Func("a", func(_ cache.Interface, target string) (*virt.File, error) {
+		for i := 0; i < 16; i++ {
+			err := tree.GenerateFile(fmt.Sprintf("bud/%d/%d.txt", i%4, i), Func("b", func(_ cache.Interface, target string) (*virt.File, error) {
+				return &virt.File{Path: target}, nil
+			}))
+			if err != nil {
+				return nil, err
+			}
+		}
+		return &virt.File{}, nil
+	})))
+	var wg sync.WaitGroup
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			target := fmt.Sprintf("bud/%d/%d.txt", i%4, i)
+			match, ok := tree.FindPrefix(target)
+			is.True(ok)
+			_, err := match.Generate(context.Background(), nil, target)
+			is.NoErr(err)
+			match, ok = tree.Find(target)
+			is.True(ok)
+			vfile, err := match.Generate(context.Background(), nil, target)
+			is.NoErr(err)
+			is.Equal(vfile.Path, target)
+			match, ok = tree.Find(path.Dir(target))
+			is.True(ok)
+			_, err = match.Generate(context.Background(), nil, path.Dir(target))
+			is.NoErr(err)
+			tree.Print()
+		}(i)
+	}
+	wg.Wait()
+	match, ok := tree.Find("bud")
+	is.True(ok)
+	vfile, err := match.Generate(context.Background(), nil, "bud")
+	is.NoErr(err)
+	is.Equal(len(vfile.Entries), 4)
+}
+
+type ctxGenerator func(ctx context.Context, target string) (*virt.File, error)
+
+func (fn ctxGenerator) Generate(ctx context.Context, _ cache.Interface, target string) (*virt.File, error) {
+	return fn(ctx, target)
+}
+
+func TestGenerateCancelledLeader(t *testing.T) {
+	is := is.New(t)
+	tree := tree.New()
+	var mu sync.Mutex
+	calls := 0
+	started := make(chan struct{})
+	is.NoErr(tree.GenerateFile("a.txt", ctxGenerator(func(ctx context.Context, target string) (*virt.File, error) {
+		mu.Lock()
+		calls++
+		call := calls
+		mu.Unlock()
+		if call == 1 {
+			close(started)
+			<-ctx.Done()
+			return nil, ctx.Err()
+		}
+		return &virt.File{Path: target, Data: []byte("a")}, nil
+	})))
+	match, ok := tree.Find("a.txt")
+	is.True(ok)
+	ctx, cancel := context.WithCancel(context.Background())
+	leader := make(chan error)
+	go func() {
+		_, err := match.Generate(ctx, nil, "a.txt")
+		leader <- err
+	}()
+	<-started
+	waiter := make(chan *virt.File)
+	go func() {
+		vfile, err := match.Generate(context.Background(), nil, "a.txt")
+		is.NoErr(err)
+		waiter <- vfile
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	is.True(errors.Is(<-leader, context.Canceled))
+	vfile := <-waiter
+	is.Equal(string(vfile.Data), "a")
+	is.Equal(calls, 2)
+}
+
+func TestGenerateCycle(t *testing.T) {
+	is := is.New(t)
+	tr := tree.New()
+	var started sync.WaitGroup
+	started.Add(2)
+	generate := func(other string) ctxGenerator {
+		return func(ctx context.Context, target string) (*virt.File, error) {
+			started.Done()
+			started.Wait()
+			match, ok := tr.Find(other)
+			if !ok {
+				return nil, fs.ErrNotExist
+			}
+			return match.Generate(ctx, nil, other)
+		}
+	}
+	is.NoErr(tr.GenerateFile("a.txt", generate("b.txt")))
+	is.NoErr(tr.GenerateFile("b.txt", generate("a.txt")))
+	errs := make(chan error, 2)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		go func(name string) {
+			match, ok := tr.Find(name)
+			is.True(ok)
+			_, err := match.Generate(context.Background(), nil, name)
+			errs <- err
+		}(name)
+	}
+	// The generator that closes the cycle fails and the other generator gets
+	// its error
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-errs:
+			var cycle *tree.CycleError
+			is.True(errors.As(err, &cycle))
+			is.Equal(len(cycle.Paths), 3)
+			is.Equal(cycle.Paths[0], cycle.Paths[2])
+		case <-time.After(5 * time.Second):
+			t.Fatal("generators waiting on each other never finished")
+		}
+	}
+}
+
+func TestTreePattern(t *testing.T) {
+	is := is.New(t)
+	tree := tree.New()
+	is.NoErr(tree.GenerateFile("posts/{slug}.html", ag))
+	is.NoErr(tree.GenerateFile("posts/index.html", bg))
+	is.NoErr(tree.GenerateDir("pkg/{name...}", cg))
+	// Literals win over patterns
+	match, ok := tree.Find("posts/index.html")
+	is.True(ok)
+	is.Equal(match.Params, nil)
+	match, ok = tree.Find("posts/hello.html")
+	is.True(ok)
+	is.Equal(match.Path, "posts/hello.html")
+	is.Equal(match.Params["slug"], "hello")
+	// Suffix must match
+	_, ok = tree.Find("posts/hello.txt")
+	is.True(!ok)
+	// Rest parameters capture multiple segments
+	match, ok = tree.FindPrefix("pkg/github.com/a/b/c.go")
+	is.True(ok)
+	is.Equal(match.Path, "pkg/github.com/a/b")
+	is.Equal(match.Params["name"], "github.com/a/b")
+	// Rest parameters are only allowed at the end
+	err := tree.GenerateFile("lib/{path...}/index.js", ag)
+	is.True(errors.Is(err, fs.ErrInvalid))
+}
+
+func TestTreeDeletePrune(t *testing.T) {
+	is := is.New(t)
+	tree := tree.New()
+	is.NoErr(tree.GenerateFile("a/b/c/d", ag))
+	is.NoErr(tree.GenerateFile("a/e", eg))
+	is.NoErr(tree.GenerateDir("f", fg))
+	is.NoErr(tree.GenerateFile("f/g/h", bg))
+	removed := tree.Delete("a/b/c/d")
+	is.Equal(removed, []string{"a/b/c/d"})
+	removed = tree.Delete("f/g/h")
+	is.Equal(removed, []string{"f/g/h"})
+	expect := `. mode=d-
+├── a mode=d-
+│   └── e mode=-g generators=e
+└── f mode=dg generators=f
+`
+	is.Equal(tree.Print(), expect)
+	removed = tree.Delete("a")
+	is.Equal(removed, []string{"a", "a/e"})
+	is.Equal(tree.Delete("a"), nil)
+	expect = `. mode=d-
+└── f mode=dg generators=f
+`
+	is.Equal(tree.Print(), expect)
+}
+
+func TestTreeRemoveGenerator(t *testing.T) {
+	is := is.New(t)
+	tree := tree.New()
+	is.NoErr(tree.GenerateDir("a", ag))
+	is.NoErr(tree.GenerateDir("a", bg))
+	is.NoErr(tree.GenerateDir("c/d", cg))
+	is.True(tree.RemoveGenerator("a", ag))
+	is.True(!tree.RemoveGenerator("a", ag))
+	is.True(tree.RemoveGenerator("c/d", cg))
+	expect := `. mode=d-
+└── a mode=dg generators=b
+`
+	is.Equal(tree.Print(), expect)
+	is.True(tree.RemoveGenerator("a", bg))
+	is.Equal(tree.Print(), `. mode=d-
+`)
+}
+
+func TestTreeDescribe(t *testing.T) {
+	is := is.New(t)
+	tr := tree.New()
+	is.NoErr(tr.GenerateFile("a/b", bg))
+	is.NoErr(tr.GenerateDir("a/c", cg))
+	is.NoErr(tr.GenerateDir("a/c", eg))
+	descriptions := tr.Describe("a")
+	is.Equal(len(descriptions), 3)
+	is.Equal(*descriptions[0], tree.Description{Path: "a", Mode: tree.ModeDir, Generators: 0})
+	is.Equal(*descriptions[1], tree.Description{Path: "a/b", Mode: tree.ModeGen, Generators: 1, Names: []string{"b"}})
+	is.Equal(*descriptions[2], tree.Description{Path: "a/c", Mode: tree.ModeGenDir, Generators: 2, Names: []string{"c", "e"}})
+	is.Equal(tr.Describe("d"), nil)
+	out, ok := tr.PrintDir("a")
+	is.True(ok)
+	is.Equal(out, `. mode=d-
+├── b mode=-g generators=b
+└── c mode=dg generators=c,e
+`)
+	_, ok = tr.PrintDir("d")
+	is.True(!ok)
+}
@@ -0,0 +1,177 @@
+package genfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ErrLimit is returned when a generator exceeds one of its limits
+var ErrLimit = errors.New("genfs: limit exceeded")
+
+// Limits constrain the resources a generator can use. Zero values mean there's
+// no limit.
+type Limits struct {
+	Timeout     time.Duration // maximum time a generator can run
+	MaxSize     int64         // maximum number of bytes a file generator can write
+	MaxChildren int           // maximum number of paths a directory generator can register
+}
+
+// Option overrides the filesystem's limits for a single registration
+type Option func(limits *Limits)
+
+// WithTimeout sets the maximum time the generator can run
+func WithTimeout(timeout time.Duration) Option {
+	return func(limits *Limits) {
+		limits.Timeout = timeout
+	}
+}
+
+// WithMaxSize sets the maximum number of bytes the file generator can write
+func WithMaxSize(size int64) Option {
+	return func(limits *Limits) {
+		limits.MaxSize = size
+	}
+}
+
+// WithMaxChildren sets the maximum number of paths the directory generator can
+// register
+func WithMaxChildren(children int) Option {
+	return func(limits *Limits) {
+		limits.MaxChildren = children
+	}
+}
+
+// limits returns the filesystem's limits with the options applied
+func (f *FileSystem) limits(options []Option) Limits {
+	limits := f.Limits
+	for _, option := range options {
+		option(&limits)
+	}
+	return limits
+}
+
+// run the generator's function within the timeout. Generators should stop when
+// their context is done, but if they don't, run returns anyway and leaves them
+// running in the background.
+func (f *FileSystem) run(ctx context.Context, reg registered, target string, timeout time.Duration, fn func() error) (err error) {
+	start := time.Now()
+	defer func() { f.profile.ran(reg, time.Since(start), err) }()
+	if f.Logger != nil {
+		start := f.logStart(ctx, reg.kind, reg.site, target)
+		defer func() { f.logFinish(ctx, reg.kind, reg.site, target, start, err) }()
+	}
+	if timeout <= 0 {
+		return f.protect(target, fn)
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- f.protect(target, fn)
+	}()
+	select {
+	case err := <-done:
+		// Report generators that stopped because of the timeout as exceeding it
+		if err != nil && errors.Is(context.Cause(ctx), ErrLimit) {
+			return context.Cause(ctx)
+		}
+		return err
+	case <-ctx.Done():
+		return context.Cause(ctx)
+	}
+}
+
+// withTimeout returns a context that's done after the timeout
+func withTimeout(ctx context.Context, timeout time.Duration) (context.Context, context.CancelFunc) {
+	if timeout <= 0 {
+		return ctx, func() {}
+	}
+	cause := fmt.Errorf("%w: generator took longer than %s", ErrLimit, timeout)
+	return context.WithTimeoutCause(ctx, timeout, cause)
+}
+
+// gate rejects writes and registrations from generators that keep running
+// after they've returned, e.g. because they ignored their timeout. A nil gate
+// is always open.
+type gate struct {
+	mu     sync.Mutex
+	closed bool
+}
+
+func newGate() *gate {
+	return &gate{}
+}
+
+// lock the gate, returning an error if the generator of the path has already
+// returned. Callers must unlock the gate if there's no error.
+func (g *gate) lock(fpath string) error {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	if g.closed {
+		g.mu.Unlock()
+		return fmt.Errorf("%w: generator of %q already returned", ErrLimit, fpath)
+	}
+	return nil
+}
+
+func (g *gate) unlock() {
+	if g != nil {
+		g.mu.Unlock()
+	}
+}
+
+// close the gate once the generator has returned
+func (g *gate) close() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.closed = true
+}
+
+// childLimit limits the number of paths a directory generator registers
+type childLimit struct {
+	max      int
+	count    atomic.Int64
+	rejected atomic.Bool // set when a path was rejected for exceeding the limit
+}
+
+func newChildLimit(n int) *childLimit {
+	if n <= 0 {
+		return nil
+	}
+	return &childLimit{max: n}
+}
+
+// check returns an error if there's no room for another child
+func (l *childLimit) check() error {
+	if l == nil {
+		return nil
+	}
+	if l.count.Load() >= int64(l.max) {
+		l.rejected.Store(true)
+		return l.err()
+	}
+	return nil
+}
+
+// add a child that was registered
+func (l *childLimit) add() {
+	if l != nil {
+		l.count.Add(1)
+	}
+}
+
+// exceeded returns an error if a child was rejected for exceeding the limit
+func (l *childLimit) exceeded() error {
+	if l == nil || !l.rejected.Load() {
+		return nil
+	}
+	return l.err()
+}
+
+func (l *childLimit) err() error {
+	return fmt.Errorf("%w: directory generator registered more than %d paths", ErrLimit, l.max)
+}
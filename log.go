@@ -0,0 +1,43 @@
+package genfs
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"log/slog"
+	"time"
+)
+
+// log a record if the filesystem has a logger
+func (f *FileSystem) log(ctx context.Context, level slog.Level, msg string, args ...any) {
+	if f.Logger == nil || !f.Logger.Enabled(ctx, level) {
+		return
+	}
+	f.Logger.Log(ctx, level, msg, args...)
+}
+
+// logCache logs whether the generator's output was found in the cache
+func (f *FileSystem) logCache(ctx context.Context, kind, site, target string, hit bool) {
+	msg := "genfs: cache miss"
+	if hit {
+		msg = "genfs: cache hit"
+	}
+	f.log(ctx, slog.LevelDebug, msg, "kind", kind, "path", f.rel(target), "generator", site)
+}
+
+func (f *FileSystem) logStart(ctx context.Context, kind, site, target string) time.Time {
+	f.log(ctx, slog.LevelDebug, "genfs: generator started", "kind", kind, "path", f.rel(target), "generator", site)
+	return time.Now()
+}
+
+func (f *FileSystem) logFinish(ctx context.Context, kind, site, target string, start time.Time, err error) {
+	args := []any{"kind", kind, "path", f.rel(target), "generator", site, "duration", time.Since(start)}
+	switch {
+	case err == nil:
+		f.log(ctx, slog.LevelDebug, "genfs: generator finished", args...)
+	case errors.Is(err, fs.ErrNotExist):
+		f.log(ctx, slog.LevelDebug, "genfs: generator found nothing", args...)
+	default:
+		f.log(ctx, slog.LevelError, "genfs: generator failed", append(args, "error", err)...)
+	}
+}
@@ -0,0 +1,57 @@
+package genfs
+
+import (
+	"context"
+	"io/fs"
+	"sync"
+)
+
+// Output is the *File or *Dir being generated
+type Output interface {
+	Context() context.Context
+	Target() string
+	Path() string
+	Mode() fs.FileMode
+	Relative() string
+	Param(name string) string
+}
+
+var _ Output = (*File)(nil)
+var _ Output = (*Dir)(nil)
+
+// Handler runs a generator
+type Handler func(fsys FS, output Output) error
+
+// Middleware wraps every file, directory and transform generator run. Cached
+// files don't run their generators, so they skip middleware too.
+type Middleware func(next Handler) Handler
+
+// Use adds middleware to the filesystem. Middleware runs in the order it was
+// added, so the first middleware added is the outermost. Middleware is shared
+// with sub filesystems and applies to generators that were registered before
+// Use was called.
+func (f *FileSystem) Use(middleware ...Middleware) {
+	f.middleware.add(middleware...)
+}
+
+// middlewares is shared between a filesystem and its sub filesystems
+type middlewares struct {
+	mu   sync.RWMutex
+	list []Middleware
+}
+
+func (m *middlewares) add(middleware ...Middleware) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.list = append(m.list, middleware...)
+}
+
+// wrap the handler with the middleware
+func (m *middlewares) wrap(handler Handler) Handler {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for i := len(m.list) - 1; i >= 0; i-- {
+		handler = m.list[i](handler)
+	}
+	return handler
+}
@@ -0,0 +1,34 @@
+package genfs
+
+// Node describes a path registered with the filesystem
+type Node struct {
+	Path       string   // path relative to the filesystem, may be a pattern
+	Mode       string   // "dg" for directory generators, "-g" for file generators and "d-" for filler directories
+	Generators int      // number of generators registered at the path
+	Sites      []string // where each generator was registered, e.g. "blog/blog.go:42"
+}
+
+// Print renders the registered generators as a tree. It's useful for
+// debugging why a path is missing. Only registered paths are printed, not the
+// fallback filesystem.
+func (f *FileSystem) Print() string {
+	s, ok := f.tree.PrintDir(f.base)
+	if !ok {
+		return ""
+	}
+	return s
+}
+
+// Describe returns every registered path in depth-first order, starting with
+// the root of the filesystem.
+func (f *FileSystem) Describe() (nodes []*Node) {
+	for _, desc := range f.tree.Describe(f.base) {
+		nodes = append(nodes, &Node{
+			Path:       f.rel(desc.Path),
+			Mode:       desc.Mode.String(),
+			Generators: desc.Generators,
+			Sites:      desc.Names,
+		})
+	}
+	return nodes
+}
@@ -0,0 +1,209 @@
+package genfs
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"sort"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// recordCache logs and profiles whether the generator's output was found in
+// the cache
+func (f *FileSystem) recordCache(ctx context.Context, reg registered, target string, hit bool) {
+	f.profile.cached(reg, hit)
+	if f.Logger != nil {
+		f.logCache(ctx, reg.kind, reg.site, target, hit)
+	}
+}
+
+// registered identifies a generator in logs and profiles
+type registered struct {
+	kind string // "file", "dir" or "transform"
+	path string // path the generator was registered at, may be a pattern
+	site string // where the generator was registered
+}
+
+// Profile of the generators that have run
+type Profile struct {
+	Entries []*ProfileEntry `json:"entries"`
+}
+
+// ProfileEntry describes how a registered path's generators performed.
+// Generators that share a directory are combined into one entry.
+type ProfileEntry struct {
+	Path     string        `json:"path"`      // registered path, may be a pattern
+	Kind     string        `json:"kind"`      // "file", "dir" or "transform"
+	Runs     int           `json:"runs"`      // number of times the generators ran
+	Errors   int           `json:"errors"`    // number of runs that failed
+	Total    time.Duration `json:"total"`     // total time spent running, in nanoseconds
+	Max      time.Duration `json:"max"`       // longest run, in nanoseconds
+	Bytes    int64         `json:"bytes"`     // bytes of file data generated
+	Hits     int           `json:"hits"`      // number of times the output was cached
+	Misses   int           `json:"misses"`    // number of times the output wasn't cached
+	HitRatio float64       `json:"hit_ratio"` // hits out of all cache lookups
+}
+
+// Profile returns how often each registered path's generators ran, how long
+// they took, how much they generated and how often their output came from the
+// cache. Entries are sorted by total time, slowest first. Paths that are
+// registered but haven't run yet are included. Profiles are shared with sub
+// filesystems.
+func (f *FileSystem) Profile() *Profile {
+	keys := map[profileKey]bool{}
+	for _, node := range f.tree.Describe(f.base) {
+		if node.Generators == 0 {
+			continue
+		}
+		key := profileKey{"file", node.Path}
+		if node.Mode.IsDir() {
+			key.kind = "dir"
+		}
+		keys[key] = true
+	}
+	// Forget generators that were removed since they last ran
+	f.profile.prune(f.base, keys)
+	entries := f.profile.snapshot()
+	// Include registered paths that haven't run yet
+	for key := range keys {
+		if _, ok := entries[key]; !ok {
+			entries[key] = &ProfileEntry{Path: key.path, Kind: key.kind}
+		}
+	}
+	profile := &Profile{}
+	for _, entry := range entries {
+		if entry.Path != f.base && !within(f.base, entry.Path) {
+			continue
+		}
+		entry.Path = f.rel(entry.Path)
+		if lookups := entry.Hits + entry.Misses; lookups > 0 {
+			entry.HitRatio = float64(entry.Hits) / float64(lookups)
+		}
+		profile.Entries = append(profile.Entries, entry)
+	}
+	sort.Slice(profile.Entries, func(i, j int) bool {
+		a, b := profile.Entries[i], profile.Entries[j]
+		if a.Total != b.Total {
+			return a.Total > b.Total
+		} else if a.Path != b.Path {
+			return a.Path < b.Path
+		}
+		return a.Kind < b.Kind
+	})
+	return profile
+}
+
+// WriteText writes the profile as a table
+func (p *Profile) WriteText(w io.Writer) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "PATH\tKIND\tRUNS\tERRORS\tTOTAL\tMAX\tBYTES\tHITS\tMISSES\tHIT RATIO")
+	for _, e := range p.Entries {
+		fmt.Fprintf(tw, "%s\t%s\t%d\t%d\t%s\t%s\t%d\t%d\t%d\t%.0f%%\n",
+			e.Path, e.Kind, e.Runs, e.Errors, e.Total, e.Max, e.Bytes, e.Hits, e.Misses, e.HitRatio*100)
+	}
+	return tw.Flush()
+}
+
+// WriteJSON writes the profile as JSON
+func (p *Profile) WriteJSON(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(p)
+}
+
+func (p *Profile) String() string {
+	s := new(strings.Builder)
+	p.WriteText(s)
+	return s.String()
+}
+
+type profileKey struct {
+	kind string
+	path string
+}
+
+// profiler records generator activity. It's shared between a filesystem and
+// its sub filesystems.
+type profiler struct {
+	mu      sync.Mutex
+	entries map[profileKey]*ProfileEntry
+}
+
+func newProfiler() *profiler {
+	return &profiler{entries: map[profileKey]*ProfileEntry{}}
+}
+
+// entry returns the entry for the generator. The lock must be held.
+func (p *profiler) entry(reg registered) *ProfileEntry {
+	key := profileKey{reg.kind, reg.path}
+	entry, ok := p.entries[key]
+	if !ok {
+		entry = &ProfileEntry{Path: reg.path, Kind: reg.kind}
+		p.entries[key] = entry
+	}
+	return entry
+}
+
+func (p *profiler) ran(reg registered, duration time.Duration, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry := p.entry(reg)
+	entry.Runs++
+	entry.Total += duration
+	if duration > entry.Max {
+		entry.Max = duration
+	}
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		entry.Errors++
+	}
+}
+
+func (p *profiler) cached(reg registered, hit bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entry := p.entry(reg)
+	if hit {
+		entry.Hits++
+	} else {
+		entry.Misses++
+	}
+}
+
+func (p *profiler) produced(reg registered, bytes int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.entry(reg).Bytes += int64(bytes)
+}
+
+// prune the file and directory entries within dir that aren't registered
+// anymore. Transforms can't be removed, so they're kept.
+func (p *profiler) prune(dir string, registered map[profileKey]bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for key := range p.entries {
+		if key.kind == "transform" || registered[key] {
+			continue
+		}
+		if key.path == dir || within(dir, key.path) {
+			delete(p.entries, key)
+		}
+	}
+}
+
+// snapshot copies the entries so they can be modified
+func (p *profiler) snapshot() map[profileKey]*ProfileEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	entries := make(map[profileKey]*ProfileEntry, len(p.entries))
+	for key, entry := range p.entries {
+		copy := *entry
+		entries[key] = &copy
+	}
+	return entries
+}
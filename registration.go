@@ -0,0 +1,228 @@
+package genfs
+
+import (
+	"context"
+	"io/fs"
+	"strconv"
+	"sync"
+
+	"github.com/matthewmueller/genfs/cache"
+	"github.com/matthewmueller/genfs/internal/tree"
+	"github.com/matthewmueller/virt"
+)
+
+// Registration identifies a single directory generator. Several generators can
+// share a directory, so the registration can be used to withdraw one of them
+// without affecting the others.
+type Registration struct {
+	gen *dirGenerator
+}
+
+// Path returns the path the generator was registered at
+func (r *Registration) Path() string {
+	return r.gen.parent.fsys.rel(r.gen.path)
+}
+
+// Remove unregisters the generator and everything it generated. Other
+// generators for the same directory are left in place. Nothing is removed if
+// the cache doesn't implement cache.Deleter.
+func (r *Registration) Remove() error {
+	g := r.gen
+	deleter, err := g.parent.fsys.deleter()
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	if g.removed {
+		g.mu.Unlock()
+		return &fs.PathError{
+			Op:   "remove",
+			Path: r.Path(),
+			Err:  fs.ErrNotExist,
+		}
+	}
+	g.removed = true
+	g.mu.Unlock()
+	g.parent.tree.RemoveGenerator(g.path, g)
+	return g.withdraw(deleter, nil)
+}
+
+// Replace swaps the generator's function, withdrawing everything the previous
+// function generated. The new function runs the next time the directory is
+// generated.
+func (r *Registration) Replace(fn func(fsys FS, dir *Dir) error) error {
+	g := r.gen
+	deleter, err := g.parent.fsys.deleter()
+	if err != nil {
+		return err
+	}
+	g.mu.Lock()
+	removed := g.removed
+	g.mu.Unlock()
+	if removed {
+		return &fs.PathError{
+			Op:   "replace",
+			Path: r.Path(),
+			Err:  fs.ErrNotExist,
+		}
+	}
+	return g.withdraw(deleter, fn)
+}
+
+func newDirGenerator(parent *Dir, fpath, site string, fn func(fsys FS, dir *Dir) error, options []Option) *dirGenerator {
+	// Generators that share a directory are cached separately. The id only
+	// depends on where the generator was registered, so the cache stays valid
+	// across restarts. Generators registered at the same path from the same site
+	// are numbered in registration order.
+	index := 0
+	for _, generator := range parent.tree.Generators(fpath) {
+		if g, ok := generator.(*dirGenerator); ok && g.site == site && g.index >= index {
+			index = g.index + 1
+		}
+	}
+	return &dirGenerator{
+		parent:  parent,
+		path:    fpath,
+		site:    site,
+		index:   index,
+		options: options,
+		fn:      fn,
+		ran:     map[string]bool{},
+		paths:   map[string]bool{},
+	}
+}
+
+type dirGenerator struct {
+	parent  *Dir
+	path    string // registered path, which may be a pattern
+	site    string // where the generator was registered
+	index   int    // distinguishes generators registered at the same path and site
+	options []Option
+
+	mu      sync.Mutex
+	fn      func(fsys FS, dir *Dir) error
+	ran     map[string]bool // directories generated by this process
+	paths   map[string]bool // paths registered by the generator
+	removed bool
+}
+
+func (g *dirGenerator) String() string {
+	return g.site
+}
+
+// key returns the cache key of the generated directory
+func (g *dirGenerator) key(reldir string) string {
+	return reldir + "\x00" + g.site + "\x00" + strconv.Itoa(g.index)
+}
+
+func (g *dirGenerator) Generate(ctx context.Context, cache cache.Interface, target string) (*virt.File, error) {
+	d := g.parent
+	// Patterns are resolved to the directory's concrete path
+	reldir := g.path
+	var params map[string]string
+	if route, ok := tree.RouteOf(ctx); ok {
+		reldir = route.Path
+		params = route.Params
+	}
+	key := g.key(reldir)
+	reg := registered{"dir", g.path, g.site}
+	g.mu.Lock()
+	fn, ran := g.fn, g.ran[reldir]
+	g.mu.Unlock()
+	// The cache only tells us whether the directory is still valid. Generators
+	// need to run at least once per process to register their files.
+	if ran {
+		if cached, err := cache.Get(key); nil == err {
+			d.fsys.recordCache(ctx, reg, reldir, true)
+			return cached, nil
+		}
+	}
+	d.fsys.recordCache(ctx, reg, reldir, false)
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	limits := d.fsys.limits(g.options)
+	ctx, cancel := withTimeout(ctx, limits.Timeout)
+	defer cancel()
+	// Invalidating the directory, its pattern or the directory generator that
+	// registered it invalidates the generated directory
+	links := []string{reldir}
+	if reldir != g.path {
+		links = append(links, g.path)
+	}
+	if d.owner != "" {
+		links = append(links, d.owner)
+	}
+	if err := cache.Link(key, links...); err != nil {
+		return nil, err
+	}
+	dir := &Dir{
+		fsys:   d.fsys,
+		tree:   d.tree,
+		target: target,
+		dir:    reldir,
+		mode:   fs.ModeDir,
+		root:   d.root,
+		owner:  key,
+		ctx:    ctx,
+		params: params,
+		gen:    g,
+		limit:  newChildLimit(limits.MaxChildren),
+		gate:   newGate(),
+	}
+	// Inputs are linked to the directory, so changing them regenerates every
+	// generator of the directory
+	fsys := scopedFS{ctx, d.fsys, cache, reldir}
+	handler := d.fsys.middleware.wrap(func(fsys FS, _ Output) error {
+		return fn(fsys, dir)
+	})
+	err := d.fsys.run(ctx, reg, target, limits.Timeout, func() error { return handler(fsys, dir) })
+	// Generators that ignored their timeout can't register paths anymore
+	dir.gate.close()
+	if err != nil {
+		return nil, d.generateError(g.path, g.site, target, err)
+	} else if err := dir.limit.exceeded(); err != nil {
+		// The generator ignored the error from registering too many paths
+		return nil, d.generateError(g.path, g.site, target, err)
+	}
+	vdir := &virt.File{
+		Path: reldir,
+		Mode: dir.mode,
+		// Intentionally nil, filled in by the tree
+		Entries: nil,
+	}
+	if err := cache.Set(key, vdir); err != nil {
+		return nil, err
+	}
+	g.mu.Lock()
+	g.ran[reldir] = true
+	g.mu.Unlock()
+	return vdir, nil
+}
+
+// record a path registered by the generator
+func (g *dirGenerator) record(fpath string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.paths[fpath] = true
+}
+
+// withdraw everything the generator registered and evict what it generated
+// from the cache. If fn isn't nil, it replaces the generator's function.
+func (g *dirGenerator) withdraw(deleter cache.Deleter, fn func(fsys FS, dir *Dir) error) error {
+	g.mu.Lock()
+	paths, ran := g.paths, g.ran
+	g.paths, g.ran = map[string]bool{}, map[string]bool{}
+	if fn != nil {
+		g.fn = fn
+	}
+	g.mu.Unlock()
+	var evict []string
+	for fpath := range paths {
+		evict = append(evict, g.parent.tree.Delete(fpath)...)
+	}
+	for reldir := range ran {
+		evict = append(evict, g.key(reldir))
+	}
+	return deleter.Delete(evict...)
+}
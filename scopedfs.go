@@ -1,17 +1,76 @@
 package genfs
 
 import (
+	"context"
 	"io/fs"
+	"path"
 
 	"github.com/matthewmueller/genfs/cache"
 )
 
+// scopedFS is the filesystem passed into generators. Every path a generator
+// opens, stats or lists is linked in the cache as a dependency of the
+// generator's output.
 type scopedFS struct {
-	fsys  fs.FS
+	ctx   context.Context
+	fsys  *FileSystem
 	cache cache.Interface
 	from  string
 }
 
+var _ fs.FS = scopedFS{}
+var _ fs.ReadDirFS = scopedFS{}
+var _ fs.StatFS = scopedFS{}
+var _ fs.ReadFileFS = scopedFS{}
+var _ fs.GlobFS = scopedFS{}
+
+// link checks that name is valid and links its path as a dependency
+func (s scopedFS) link(op, name string) (string, error) {
+	target, err := s.fsys.path(op, name)
+	if err != nil {
+		return "", err
+	}
+	if err := s.cache.Link(s.from, target); err != nil {
+		return "", err
+	}
+	return target, nil
+}
+
 func (s scopedFS) Open(name string) (fs.File, error) {
-	return s.fsys.Open(name)
+	target, err := s.link("open", name)
+	if err != nil {
+		return nil, err
+	}
+	return s.fsys.open(s.ctx, s.cache, target)
+}
+
+func (s scopedFS) ReadDir(name string) ([]fs.DirEntry, error) {
+	target, err := s.link("readdir", name)
+	if err != nil {
+		return nil, err
+	}
+	return s.fsys.readDir(s.ctx, s.cache, target)
+}
+
+func (s scopedFS) Stat(name string) (fs.FileInfo, error) {
+	target, err := s.link("stat", name)
+	if err != nil {
+		return nil, err
+	}
+	return s.fsys.stat(s.ctx, s.cache, target)
+}
+
+func (s scopedFS) ReadFile(name string) ([]byte, error) {
+	target, err := s.link("readfile", name)
+	if err != nil {
+		return nil, err
+	}
+	return s.fsys.readFile(s.ctx, s.cache, target)
+}
+
+func (s scopedFS) Glob(pattern string) ([]string, error) {
+	if err := s.cache.Link(s.from, path.Join(s.fsys.base, pattern)); err != nil {
+		return nil, err
+	}
+	return s.fsys.glob(s.ctx, s.cache, pattern)
 }
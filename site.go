@@ -0,0 +1,18 @@
+package genfs
+
+import (
+	"path"
+	"runtime"
+	"strconv"
+)
+
+// caller returns the file and line of the code that called the registration
+// method, skipping the given number of frames within genfs. Paths are
+// shortened to their directory and file name, e.g. "blog/blog.go:42".
+func caller(skip int) string {
+	_, file, line, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return "unknown"
+	}
+	return path.Join(path.Base(path.Dir(file)), path.Base(file)) + ":" + strconv.Itoa(line)
+}
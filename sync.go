@@ -0,0 +1,205 @@
+package genfs
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// syncManifest lists the files that Sync wrote, so they can be removed once
+// they're no longer generated.
+const syncManifest = ".genfs"
+
+// Sync writes fsys to dir. Only files whose content or mode changed are
+// written, so file watchers aren't triggered needlessly. Files written by a
+// previous Sync that no longer exist in fsys are removed. Other files in dir
+// are left alone.
+func Sync(fsys fs.FS, dir string) error {
+	previous, err := readManifest(dir)
+	if err != nil {
+		return err
+	}
+	written := map[string]bool{}
+	dirs := map[string]bool{}
+	err = fs.WalkDir(fsys, ".", func(fpath string, de fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if fpath == syncManifest {
+			return nil
+		}
+		target := filepath.Join(dir, filepath.FromSlash(fpath))
+		if de.IsDir() {
+			dirs[fpath] = true
+			return syncDir(target)
+		}
+		written[fpath] = true
+		return syncFile(fsys, fpath, target)
+	})
+	if err != nil {
+		return err
+	}
+	// Remove files we previously wrote that are no longer present. Files that
+	// turned into directories were already replaced while syncing.
+	for fpath := range previous {
+		if written[fpath] || dirs[fpath] {
+			continue
+		}
+		if err := removeStale(dir, fpath, dirs); err != nil {
+			return err
+		}
+	}
+	return writeManifest(dir, previous, written)
+}
+
+func syncDir(target string) error {
+	stat, err := os.Lstat(target)
+	if err == nil && stat.IsDir() {
+		return nil
+	} else if err == nil {
+		// A file is in the way of the directory
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return os.MkdirAll(target, 0755)
+}
+
+func syncFile(fsys fs.FS, fpath, target string) error {
+	file, err := fsys.Open(fpath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return err
+	}
+	perm := stat.Mode().Perm()
+	if perm == 0 {
+		perm = 0644
+	}
+	existing, err := os.Lstat(target)
+	if err == nil && existing.Mode().IsRegular() && existing.Mode().Perm() == perm && existing.Size() == int64(len(data)) {
+		current, err := os.ReadFile(target)
+		if err != nil {
+			return err
+		}
+		if bytes.Equal(current, data) {
+			return nil
+		}
+	} else if err == nil && existing.IsDir() {
+		// A directory is in the way of the file
+		if err := os.RemoveAll(target); err != nil {
+			return err
+		}
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return writeFile(target, data, perm)
+}
+
+// writeFile atomically writes data to target
+func writeFile(target string, data []byte, perm fs.FileMode) error {
+	tmp, err := os.CreateTemp(filepath.Dir(target), ".genfs-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), perm); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), target)
+}
+
+// removeStale removes the file along with any parent directories that are
+// now empty, except for the directories that were synced. Only regular files
+// are removed.
+func removeStale(dir, fpath string, synced map[string]bool) error {
+	target := filepath.Join(dir, filepath.FromSlash(fpath))
+	stat, err := os.Lstat(target)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		return err
+	} else if !stat.Mode().IsRegular() {
+		return nil
+	}
+	if err := os.Remove(target); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	for parent := path.Dir(fpath); parent != "." && !synced[parent]; parent = path.Dir(parent) {
+		des, err := os.ReadDir(filepath.Join(dir, filepath.FromSlash(parent)))
+		if err != nil || len(des) > 0 {
+			return nil
+		}
+		if err := os.Remove(filepath.Join(dir, filepath.FromSlash(parent))); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readManifest(dir string) (map[string]bool, error) {
+	data, err := os.ReadFile(filepath.Join(dir, syncManifest))
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return map[string]bool{}, nil
+		}
+		return nil, err
+	}
+	paths := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		if line != "" {
+			paths[line] = true
+		}
+	}
+	return paths, nil
+}
+
+func writeManifest(dir string, previous, written map[string]bool) error {
+	if len(previous) == len(written) {
+		unchanged := true
+		for fpath := range written {
+			if !previous[fpath] {
+				unchanged = false
+				break
+			}
+		}
+		if unchanged {
+			return nil
+		}
+	}
+	paths := make([]string, 0, len(written))
+	for fpath := range written {
+		paths = append(paths, fpath)
+	}
+	sort.Strings(paths)
+	data := strings.Join(paths, "\n")
+	if data != "" {
+		data += "\n"
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return err
+	}
+	return writeFile(filepath.Join(dir, syncManifest), []byte(data), 0644)
+}
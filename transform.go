@@ -0,0 +1,222 @@
+package genfs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/matthewmueller/genfs/cache"
+	"github.com/matthewmueller/virt"
+)
+
+type FileTransformer interface {
+	TransformFile(fsys FS, file *File, source []byte) error
+}
+
+// Transform exposes a generated sibling with the toExt extension for every file
+// with the fromExt extension in the fallback filesystem. For example,
+// Transform(".md", ".html", fn) generates "docs/intro.html" from
+// "docs/intro.md". The function receives the contents of the source file and
+// File.Source returns its path. Generated and fallback files with the same
+// name take precedence over transformed files.
+func (f *FileSystem) Transform(fromExt, toExt string, fn func(fsys FS, file *File, source []byte) error, options ...Option) error {
+	return f.addTransform(caller(1), fromExt, toExt, fn, options)
+}
+
+func (f *FileSystem) FileTransformer(fromExt, toExt string, transformer FileTransformer, options ...Option) error {
+	return f.addTransform(caller(1), fromExt, toExt, transformer.TransformFile, options)
+}
+
+func (f *FileSystem) addTransform(site, fromExt, toExt string, fn func(fsys FS, file *File, source []byte) error, options []Option) error {
+	for _, ext := range []string{fromExt, toExt} {
+		if !validExt(ext) {
+			return &fs.PathError{
+				Op:   "transform",
+				Path: ext,
+				Err:  fmt.Errorf("%w: expected an extension like \".md\"", fs.ErrInvalid),
+			}
+		}
+	}
+	if fromExt == toExt {
+		return &fs.PathError{
+			Op:   "transform",
+			Path: toExt,
+			Err:  fmt.Errorf("%w: extensions must differ", fs.ErrInvalid),
+		}
+	}
+	f.transforms.add(&transform{
+		fsys:    f,
+		dir:     f.base,
+		site:    site,
+		fromExt: fromExt,
+		toExt:   toExt,
+		fn:      fn,
+		options: options,
+	})
+	return nil
+}
+
+func validExt(ext string) bool {
+	return len(ext) > 1 && ext[0] == '.' && !strings.ContainsAny(ext, "/*?[\\")
+}
+
+type transform struct {
+	fsys    *FileSystem // filesystem the transform was registered with
+	dir     string
+	site    string // where the transform was registered
+	fromExt string
+	toExt   string
+	fn      func(fsys FS, file *File, source []byte) error
+	options []Option
+}
+
+// source returns the path of the file that target would be transformed from
+func (t *transform) source(target string) (string, bool) {
+	if !strings.HasSuffix(target, t.toExt) || !within(t.dir, target) {
+		return "", false
+	}
+	name := strings.TrimSuffix(target, t.toExt)
+	if name == "" || strings.HasSuffix(name, "/") {
+		return "", false
+	}
+	return name + t.fromExt, true
+}
+
+// target returns the path that source would be transformed into
+func (t *transform) target(source string) (string, bool) {
+	if !strings.HasSuffix(source, t.fromExt) || !within(t.dir, source) {
+		return "", false
+	}
+	name := strings.TrimSuffix(source, t.fromExt)
+	if name == "" || strings.HasSuffix(name, "/") {
+		return "", false
+	}
+	return name + t.toExt, true
+}
+
+func (t *transform) generate(ctx context.Context, cache cache.Interface, source, target string) (*virt.File, error) {
+	var data []byte
+	return t.fsys.runFile(ctx, cache, target, fileRun{
+		reg:     registered{"transform", path.Join(t.dir, "*"+t.toExt), t.site},
+		options: t.options,
+		prepare: func(ctx context.Context) (*File, error) {
+			info, err := fs.Stat(t.fsys.fsys, source)
+			if err != nil {
+				return nil, err
+			}
+			data, err = fs.ReadFile(t.fsys.fsys, source)
+			if err != nil {
+				return nil, err
+			}
+			// Changing the source file should invalidate the transformed file
+			if err := cache.Link(target, source); err != nil {
+				return nil, err
+			}
+			return &File{
+				target: t.fsys.rel(target),
+				path:   relativePath(t.dir, target),
+				// Transformed files have the same permissions as their source
+				mode:   sourceMode(info),
+				root:   t.fsys.Root,
+				source: relativePath(t.dir, source),
+			}, nil
+		},
+		fn: func(fsys FS, file *File) error {
+			return t.fn(fsys, file, data)
+		},
+	})
+}
+
+// within returns true if target is inside of dir
+func within(dir, target string) bool {
+	return dir == "." || strings.HasPrefix(target, dir+"/")
+}
+
+// transforms is shared between a filesystem and its sub filesystems
+type transforms struct {
+	mu   sync.RWMutex
+	list []*transform
+}
+
+func (ts *transforms) add(t *transform) {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.list = append(ts.list, t)
+}
+
+func (ts *transforms) all() []*transform {
+	ts.mu.RLock()
+	defer ts.mu.RUnlock()
+	return ts.list[:len(ts.list):len(ts.list)]
+}
+
+// transform the target from its source in the fallback filesystem. Transforms
+// are tried in the order they were registered.
+func (f *FileSystem) transform(ctx context.Context, cache cache.Interface, target string) (*virt.File, error) {
+	for _, t := range f.transforms.all() {
+		source, ok := t.source(target)
+		if !ok {
+			continue
+		}
+		ctx, err := f.checkCycle(ctx, target)
+		if err != nil {
+			return nil, err
+		}
+		// Concurrent reads of the same file share a single run of the transform
+		key := "transform\x00" + source + "\x00" + target
+		vfile, err := f.tree.Do(ctx, key, target, func(ctx context.Context) (*virt.File, error) {
+			return t.generate(ctx, cache, source, target)
+		})
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			// Failures of the transform's function already describe the transform
+			var generateErr *GenerateError
+			if errors.As(err, &generateErr) {
+				return nil, err
+			}
+			return nil, fmt.Errorf("genfs: error transforming %q: %w", source, f.treeError(err))
+		}
+		return vfile, nil
+	}
+	return nil, fmt.Errorf("genfs: %q %w", target, fs.ErrNotExist)
+}
+
+// transformEntries returns the entries of transformed files for the entries
+// of dir in the fallback filesystem
+func (f *FileSystem) transformEntries(ctx context.Context, cache cache.Interface, dir string, des []fs.DirEntry) (entries []fs.DirEntry) {
+	transforms := f.transforms.all()
+	if len(transforms) == 0 {
+		return nil
+	}
+	for _, de := range des {
+		if de.IsDir() {
+			continue
+		}
+		for _, t := range transforms {
+			target, ok := t.target(path.Join(dir, de.Name()))
+			if !ok {
+				continue
+			}
+			info, err := de.Info()
+			if err != nil {
+				continue
+			}
+			entries = append(entries, wrapEntry(ctx, f, cache, &virt.DirEntry{
+				Path: target,
+				Mode: sourceMode(info),
+			}))
+		}
+	}
+	return entries
+}
+
+// sourceMode returns the mode of a file transformed from source
+func sourceMode(source fs.FileInfo) fs.FileMode {
+	return source.Mode().Perm()
+}
@@ -1,21 +1,26 @@
 package genfs
 
 import (
+	"context"
 	"io"
 	"io/fs"
+	"sync"
+	"time"
 
+	"github.com/matthewmueller/genfs/cache"
 	"github.com/matthewmueller/virt"
 )
 
 // wrapFile turns a virt.File into an fs.File. Unlike virt.Open
-func wrapFile(fsys fs.FS, path string, file fs.File) fs.File {
-	return &fsFile{file, fsys, path, 0}
+func wrapFile(ctx context.Context, fsys *FileSystem, path string, file fs.File) fs.File {
+	return &fsFile{file, ctx, fsys, path, 0}
 }
 
 type fsFile struct {
 	fs.File
-	fsys   fs.FS
-	path   string
+	ctx    context.Context // context the file was opened with
+	fsys   *FileSystem
+	path   string // path within the tree
 	offset int64
 }
 
@@ -24,7 +29,7 @@ var _ io.Seeker = (*fsFile)(nil)
 var _ fs.ReadDirFile = (*fsFile)(nil)
 
 func (f *fsFile) ReadDir(count int) ([]fs.DirEntry, error) {
-	des, err := fs.ReadDir(f.fsys, f.path)
+	des, err := f.fsys.readDir(f.ctx, f.fsys.Cache, f.path)
 	if err != nil {
 		return nil, err
 	}
@@ -56,15 +61,84 @@ func (f *fsFile) Seek(offset int64, whence int) (int64, error) {
 	return seeker.Seek(offset, whence)
 }
 
-func wrapEntry(tree fs.FS, de *virt.DirEntry) fs.DirEntry {
-	return &dirEntry{de, tree}
+func wrapEntry(ctx context.Context, fsys *FileSystem, cache cache.Interface, de *virt.DirEntry) fs.DirEntry {
+	return &dirEntry{de, ctx, fsys, cache}
 }
 
 type dirEntry struct {
 	*virt.DirEntry
-	tree fs.FS
+	ctx   context.Context // context the directory was read with
+	fsys  *FileSystem
+	cache cache.Interface // cache the directory was read with
 }
 
+// Info describes the entry without running its generator, otherwise walking
+// the filesystem and calling Info would run every generator. Files that have
+// been generated are described by their cached output.
 func (de *dirEntry) Info() (fs.FileInfo, error) {
-	return fs.Stat(de.tree, de.Path)
+	if de.IsDir() {
+		return de.DirEntry.Info()
+	}
+	if vfile, err := de.cache.Get(de.Path); err == nil {
+		entry := &virt.DirEntry{
+			Path:    de.Path,
+			Mode:    vfile.Mode,
+			ModTime: vfile.ModTime,
+			Size:    int64(len(vfile.Data)),
+		}
+		return entry.Info()
+	}
+	return &entryInfo{entry: de}, nil
+}
+
+// entryInfo describes a file that hasn't been generated yet. Its name and mode
+// come from the tree, but its size and modification time aren't known until
+// the file is generated, so the generator runs the first time they're needed.
+type entryInfo struct {
+	entry *dirEntry
+	once  sync.Once
+	info  fs.FileInfo
+}
+
+var _ fs.FileInfo = (*entryInfo)(nil)
+
+func (i *entryInfo) Name() string {
+	return i.entry.Name()
+}
+
+func (i *entryInfo) Mode() fs.FileMode {
+	return i.entry.Mode
+}
+
+func (i *entryInfo) IsDir() bool {
+	return false
+}
+
+func (i *entryInfo) Size() int64 {
+	if info := i.generate(); info != nil {
+		return info.Size()
+	}
+	return 0
+}
+
+func (i *entryInfo) ModTime() time.Time {
+	if info := i.generate(); info != nil {
+		return info.ModTime()
+	}
+	return time.Time{}
+}
+
+func (i *entryInfo) Sys() any {
+	return nil
+}
+
+// generate the file, returning nil if it can't be generated
+func (i *entryInfo) generate() fs.FileInfo {
+	i.once.Do(func() {
+		de := i.entry
+		if info, err := de.fsys.stat(de.ctx, de.cache, de.Path); err == nil {
+			i.info = info
+		}
+	})
+	return i.info
 }